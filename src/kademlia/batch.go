@@ -0,0 +1,355 @@
+package kademlia
+
+// Contains the batched stores and lookups used to vanish and unvanish a VDO.
+// Looking up N keys one at a time takes N lookups that each query the same
+// close nodes over and over. Here the lookups of all keys run together: each
+// key keeps its own shortlist, but the queries for one round are grouped by
+// contact, so a node close to several keys gets one FindNodeBatch or
+// FindValueBatch for all of them, and the values end up on each node in one
+// StoreBatch.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Store items on contact in one RPC. The indexes of the items contact refused
+// are returned with an error matching ErrStoreRefused.
+func (k *Kademlia) StoreBatch(ctx context.Context, contact *Contact, items []StoreItem) ([]int, error) {
+	storeBatchReq := new(StoreBatchRequest)
+	storeBatchReq.MsgID = NewRandomID()
+	storeBatchReq.Sender = k.SelfContact
+	storeBatchReq.Items = items
+
+	storeBatchRes := new(StoreBatchResult)
+	if err := k.call(ctx, *contact, "StoreBatch", storeBatchReq, storeBatchRes); err != nil {
+		k.contactFailed(*contact, err)
+		return nil, err
+	}
+	k.learnContact(*contact)
+	return storeBatchRes.Refused, storeBatchRes.Err
+}
+
+// Ask contact for the nodes it knows closest to each of nodeIDs in one RPC,
+// the i-th result is what FindNode of nodeIDs[i] would return.
+func (k *Kademlia) FindNodeBatch(ctx context.Context, contact *Contact, nodeIDs []ID) ([][]Contact, error) {
+	findNodeBatchReq := new(FindNodeBatchRequest)
+	findNodeBatchReq.MsgID = NewRandomID()
+	findNodeBatchReq.Sender = k.SelfContact
+	findNodeBatchReq.NodeIDs = nodeIDs
+
+	findNodeBatchRes := new(FindNodeBatchResult)
+	if err := k.call(ctx, *contact, "FindNodeBatch", findNodeBatchReq, findNodeBatchRes); err != nil {
+		k.contactFailed(*contact, err)
+		return nil, err
+	}
+	if findNodeBatchRes.Err != nil {
+		return nil, findNodeBatchRes.Err
+	}
+	if len(findNodeBatchRes.Nodes) != len(nodeIDs) {
+		return nil, fmt.Errorf("FindNodeBatch returned %d results for %d node IDs", len(findNodeBatchRes.Nodes), len(nodeIDs))
+	}
+
+	//update contact
+	k.learnContact(*contact)
+	for _, nodes := range findNodeBatchRes.Nodes {
+		for _, c := range nodes {
+			k.learnContact(c)
+		}
+	}
+	return findNodeBatchRes.Nodes, nil
+}
+
+// Ask contact for the values of keys in one RPC, the i-th result is what
+// FindValue of keys[i] would return.
+func (k *Kademlia) FindValueBatch(ctx context.Context, contact *Contact, keys []ID) ([]FindValueResult, error) {
+	findValueBatchReq := new(FindValueBatchRequest)
+	findValueBatchReq.MsgID = NewRandomID()
+	findValueBatchReq.Sender = k.SelfContact
+	findValueBatchReq.Keys = keys
+
+	findValueBatchRes := new(FindValueBatchResult)
+	if err := k.call(ctx, *contact, "FindValueBatch", findValueBatchReq, findValueBatchRes); err != nil {
+		k.contactFailed(*contact, err)
+		return nil, err
+	}
+	if findValueBatchRes.Err != nil {
+		return nil, findValueBatchRes.Err
+	}
+	if len(findValueBatchRes.Results) != len(keys) {
+		return nil, fmt.Errorf("FindValueBatch returned %d results for %d keys", len(findValueBatchRes.Results), len(keys))
+	}
+
+	//update contact
+	k.learnContact(*contact)
+	for _, result := range findValueBatchRes.Results {
+		for _, c := range result.Nodes {
+			k.learnContact(c)
+		}
+	}
+	return findValueBatchRes.Results, nil
+}
+
+//one FindNodeBatch or FindValueBatch of a lookup round, entries[i] is
+//contact's entry in the shortlist of the targets[i]-th target
+type batchQuery struct {
+	contact Contact
+	targets []int
+	entries []*lookupEntry
+}
+
+type batchReply struct {
+	query   *batchQuery
+	results []FindValueResult
+	err     error
+}
+
+//the lookup of each target, run together. Every target is looked up as by
+//lookup, node lookups ask with FindNodeBatch so nodes holding a value still
+//answer with closer nodes.
+func (k *Kademlia) lookupBatch(ctx context.Context, targets []ID, mode int) ([]lookupResult, error) {
+	lists := make([]*shortlist, len(targets))
+	values := make([][]byte, len(targets))
+	valueTTLs := make([]time.Duration, len(targets))
+	results := func() []lookupResult {
+		results := make([]lookupResult, len(lists))
+		for i, s := range lists {
+			results[i] = s.result()
+			results[i].value, results[i].valueTTL = values[i], valueTTLs[i]
+		}
+		return results
+	}
+
+	for i, target := range targets {
+		lists[i] = &shortlist{target: target, seen: map[ID]bool{k.NodeID: true}}
+	}
+	if err := ctx.Err(); err != nil {
+		return results(), contextError(ctx, err)
+	}
+	for i, target := range targets {
+		k.touchBucket(target)
+		for _, c := range k.table.Closest(target, k.NodeID, MAX_BUCKET_SIZE) {
+			lists[i].add(c)
+		}
+	}
+	//cancels the queries still in flight when the lookup returns
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	replies := make(chan batchReply)
+	inFlight := make([]int, len(targets))
+	for {
+		//pick each target's next queries as lookup does, then send one
+		//query to each contact picked
+		queries := make(map[ID]*batchQuery)
+		var order []*batchQuery
+		done := true
+		for i, s := range lists {
+			if mode == lookupValue && values[i] != nil {
+				continue
+			}
+			active := 0
+			for _, e := range s.entries {
+				if active == MAX_BUCKET_SIZE {
+					break
+				}
+				if e.state == lookupFailed {
+					continue
+				}
+				active++
+				if e.state == lookupUnqueried && inFlight[i] < ALPHA {
+					e.state = lookupInFlight
+					inFlight[i]++
+					q, ok := queries[e.contact.NodeID]
+					if !ok {
+						q = &batchQuery{contact: e.contact}
+						queries[e.contact.NodeID] = q
+						order = append(order, q)
+					}
+					q.targets = append(q.targets, i)
+					q.entries = append(q.entries, e)
+				}
+				if e.state == lookupInFlight {
+					done = false
+				}
+			}
+		}
+		if done {
+			break
+		}
+		for _, q := range order {
+			go k.lookupBatchQuery(ctx, q, targets, mode, replies)
+		}
+
+		select {
+		case reply := <-replies:
+			for j, i := range reply.query.targets {
+				e := reply.query.entries[j]
+				inFlight[i]--
+				if reply.err != nil {
+					e.state = lookupFailed
+					continue
+				}
+				e.state = lookupReplied
+				result := reply.results[j]
+				if result.Value != nil {
+					e.value = result.Value
+					if values[i] == nil {
+						values[i], valueTTLs[i] = result.Value, result.TTL
+					}
+				}
+				for _, c := range result.Nodes {
+					lists[i].add(c)
+				}
+			}
+		case <-ctx.Done():
+			return results(), contextError(ctx, ctx.Err())
+		}
+	}
+	return results(), nil
+}
+
+func (k *Kademlia) lookupBatchQuery(ctx context.Context, q *batchQuery, targets []ID, mode int, replies chan batchReply) {
+	keys := make([]ID, len(q.targets))
+	for j, i := range q.targets {
+		keys[j] = targets[i]
+	}
+	contact := q.contact
+	reply := batchReply{query: q}
+	if mode == lookupNodes {
+		var nodes [][]Contact
+		nodes, reply.err = k.FindNodeBatch(ctx, &contact, keys)
+		for _, n := range nodes {
+			reply.results = append(reply.results, FindValueResult{Nodes: n})
+		}
+	} else {
+		reply.results, reply.err = k.FindValueBatch(ctx, &contact, keys)
+	}
+	select {
+	case replies <- reply:
+	case <-ctx.Done():
+	}
+}
+
+// Store each value on the closest nodes to its key for ttl, looking up all
+// keys together and sending each node its values in one StoreBatch. This
+// node republishes the values until ttl has passed. It returns how many
+// values were stored on at least one node, the error is nil when all were.
+func (k *Kademlia) IterativeStoreBatch(ctx context.Context, values map[ID][]byte, ttl time.Duration) (int, error) {
+	items := make([]StoreItem, 0, len(values))
+	for key, value := range values {
+		k.publish(key, value, ttl)
+		items = append(items, StoreItem{key, value, ttl})
+	}
+	return k.storeClosestBatch(ctx, items)
+}
+
+//store each item on the closest nodes to its key, returning how many were
+//stored on at least one node
+func (k *Kademlia) storeClosestBatch(ctx context.Context, items []StoreItem) (int, error) {
+	keys := make([]ID, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	results, lookupErr := k.lookupBatch(ctx, keys, lookupNodes)
+
+	//the items each contact is to store in a round
+	type contactItems struct {
+		contact Contact
+		items   []StoreItem
+		indexes []int
+	}
+	byContact := make(map[ID]*contactItems)
+	var order []*contactItems
+	assign := func(c Contact, i int) {
+		ci, ok := byContact[c.NodeID]
+		if !ok {
+			ci = &contactItems{contact: c}
+			byContact[c.NodeID] = ci
+			order = append(order, ci)
+		}
+		ci.items = append(ci.items, items[i])
+		ci.indexes = append(ci.indexes, i)
+	}
+	tried := make([]map[ID]bool, len(items))
+	for i, result := range results {
+		tried[i] = make(map[ID]bool, len(result.closest))
+		for _, c := range result.closest {
+			tried[i][c.NodeID] = true
+			assign(c, i)
+		}
+	}
+
+	//an item a node refused is offered to the next closest node that wasn't
+	//tried yet in the next round, as storeClosest does
+	stored := make([]bool, len(items))
+	spares := make([][]Contact, len(items))
+	var lastErr error
+	for len(order) > 0 {
+		round := order
+		byContact, order = make(map[ID]*contactItems), nil
+		for _, ci := range round {
+			refused, err := k.StoreBatch(ctx, &ci.contact, ci.items)
+			if err != nil {
+				lastErr = err
+				if !errors.Is(err, ErrStoreRefused) {
+					continue
+				}
+			}
+			wasRefused := make(map[int]bool, len(refused))
+			for _, j := range refused {
+				wasRefused[j] = true
+			}
+			for j, i := range ci.indexes {
+				if !wasRefused[j] {
+					stored[i] = true
+					continue
+				}
+				if spares[i] == nil {
+					spares[i] = k.table.Closest(items[i].Key, k.NodeID, 2*MAX_BUCKET_SIZE)
+				}
+				for len(spares[i]) > 0 && tried[i][spares[i][0].NodeID] {
+					spares[i] = spares[i][1:]
+				}
+				if len(spares[i]) > 0 {
+					tried[i][spares[i][0].NodeID] = true
+					assign(spares[i][0], i)
+					spares[i] = spares[i][1:]
+				}
+			}
+		}
+	}
+	missing := 0
+	for _, ok := range stored {
+		if !ok {
+			missing++
+		}
+	}
+	if missing == 0 {
+		return len(items), nil
+	}
+	if lastErr == nil {
+		lastErr = lookupErr
+	}
+	if lastErr == nil {
+		lastErr = ErrNotFound
+	}
+	return len(items) - missing, fmt.Errorf("%d of %d values not stored: %w", missing, len(items), lastErr)
+}
+
+// Look up each key as IterativeFindValues does, all keys together. The i-th
+// values are those found for keys[i], nil when nobody returned one. The
+// error is only set when ctx ended first.
+func (k *Kademlia) IterativeFindValuesBatch(ctx context.Context, keys []ID) ([][]FoundValue, error) {
+	results, err := k.lookupBatch(ctx, keys, lookupValues)
+	if err != nil {
+		return nil, err
+	}
+	values := make([][]FoundValue, len(keys))
+	for i, result := range results {
+		values[i] = sortFoundValues(result.values)
+	}
+	return values, nil
+}
@@ -0,0 +1,131 @@
+package kademlia
+
+// Contains the client side of the RPCs: dialing peers and making calls that
+// give up when their context ends.
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strconv"
+	"time"
+)
+
+// Answer of the Go RPC HTTP handler to a CONNECT.
+const rpcConnected = "200 Connected to Go RPC"
+
+// Like rpc.DialHTTPPath, but the dial and handshake stop when ctx ends.
+func dialHTTPPath(ctx context.Context, address string, path string) (*rpc.Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	//unblock the handshake once ctx ends rather than at its deadline, so a
+	//timeout is reported as ctx's error and not as the read's
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+	io.WriteString(conn, "CONNECT "+path+" HTTP/1.0\n\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != rpcConnected {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClient(conn), nil
+}
+
+// Resolve a host:port address to the IPv4 address and port of a node, or to
+// its first address when it has no IPv4 one.
+func ResolveAddr(ctx context.Context, addr string) (host net.IP, port uint16, err error) {
+	hostname, portstr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	portInt, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil {
+		return
+	}
+	ipAddrStrings, err := net.DefaultResolver.LookupHost(ctx, hostname)
+	if err != nil {
+		return
+	}
+	for i := 0; i < len(ipAddrStrings); i++ {
+		host = net.ParseIP(ipAddrStrings[i])
+		if host.To4() != nil {
+			break
+		}
+	}
+	return host, uint16(portInt), nil
+}
+
+//errors caused by ctx ending are reported as ErrTimeout when it ran out of
+//time and as context.Canceled when it was cancelled
+func contextError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("%w: %w", ErrTimeout, ctx.Err())
+	case context.Canceled:
+		return ctx.Err()
+	}
+	return err
+}
+
+//make one RPC to the KademliaCore of to over a pooled connection, giving up
+//when ctx ends or after RPC_TIMEOUT. to's NodeID is zero when we only know
+//its address.
+func (k *Kademlia) call(ctx context.Context, to Contact, method string, req interface{}, res interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, RPC_TIMEOUT)
+	defer cancel()
+
+	portStr := strconv.Itoa(int(to.Port))
+	address := to.Host.String() + ":" + portStr
+	for {
+		//every try is signed with a fresh nonce, the peer may have taken
+		//the request of the one before
+		nonce := NewRandomID()
+		if msg, ok := req.(signable); ok {
+			//the nonce comes back in the response even when we don't sign
+			msg.signed().Nonce = nonce
+			if k.identity != nil {
+				if err := k.identity.sign(method, msg, to.NodeID, k.config.Clock.Now()); err != nil {
+					return err
+				}
+			}
+		}
+
+		client, err := k.pool.get(ctx, address, rpc.DefaultRPCPath+portStr)
+		if err != nil {
+			return contextError(ctx, fmt.Errorf("%w: %v", ErrUnreachable, err))
+		}
+
+		call := client.Go("KademliaCore."+method, req, res, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+			err = serverError(call.Error)
+			if msg, ok := res.(signable); ok && err == nil && k.config.VerifyNodeIDs {
+				err = k.verifyResponse(method, msg, to.NodeID, nonce)
+			}
+		case <-ctx.Done():
+			err = contextError(ctx, ctx.Err())
+		}
+		//a client given back after a timeout is closed, which also aborts
+		//the call still in flight
+		k.pool.put(address, client, err)
+
+		//the peer closed a pooled connection before the request was sent,
+		//the next try gets another connection or dials a new one
+		if err != rpc.ErrShutdown {
+			return err
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package kademlia
+
+// Contains the clock a node reads the time from, so that tests can replace it
+// with one they move forward by hand.
+
+import (
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -31,8 +31,6 @@ func (id ID) Compare(other ID) int {
 	for i := 0; i < IDBytes; i++ {
 		difference := int(id[i]) - int(other[i])
 		switch {
-		case difference == 0:
-			return 0
 		case difference < 0:
 			return -1
 		case difference > 0:
@@ -0,0 +1,257 @@
+package kademlia
+
+// Contains node identities bound to Ed25519 keys, as in S/Kademlia. A node's
+// ID is the SHA-1 hash of its public key, and it signs its requests and
+// responses so peers can check it holds the key behind the NodeID it claims. A node
+// can then only place itself next to the Vanish shares it wants to harvest by
+// generating keys until one hashes there; IDPuzzleBits makes every try cost
+// more by only accepting IDs whose own hash starts with that many zero bits.
+//
+// Signatures cover the name of the method and the JSON encoding of the
+// message as gob delivers it, which unlike gob is the same in every process,
+// along with the
+// NodeID of the recipient, a nonce and the time of signing. A request is only
+// taken by the node it was sent to, within SIGNATURE_WINDOW of being signed
+// and once, and a response carries the nonce of its request, so neither can
+// be replayed.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	// Puzzle bits of the nodes started from main, each one doubles the work
+	// of generating an identity.
+	ID_PUZZLE_BITS = 12
+
+	// How far from our clock the time a request was signed may be.
+	SIGNATURE_WINDOW = time.Minute
+)
+
+var (
+	ErrBadSignature = errors.New("bad signature")
+	ErrStaleMessage = errors.New("stale or replayed message")
+)
+
+// A node's key pair, its NodeID is the hash of the public key.
+type Identity struct {
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+}
+
+func (id *Identity) NodeID() ID {
+	return NodeIDFromKey(id.PublicKey)
+}
+
+// The NodeID of the node holding key.
+func NodeIDFromKey(key ed25519.PublicKey) ID {
+	return ID(sha1.Sum(key))
+}
+
+//whether nodeID solves the puzzle of the given difficulty
+func puzzleSolved(nodeID ID, bits int) bool {
+	return ID(sha1.Sum(nodeID[:])).PrefixLen() >= bits
+}
+
+// Generate keys until one has a NodeID solving the puzzle of bits bits.
+func GenerateIdentity(bits int) (*Identity, error) {
+	for {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		id := &Identity{public, private}
+		if puzzleSolved(id.NodeID(), bits) {
+			return id, nil
+		}
+	}
+}
+
+// Load the identity kept at path, generating it and saving it there when
+// there is none yet. It must solve the puzzle of bits bits.
+func LoadIdentity(path string, bits int) (*Identity, error) {
+	seed, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		id, err := GenerateIdentity(bits)
+		if err != nil {
+			return nil, err
+		}
+		return id, os.WriteFile(path, id.PrivateKey.Seed(), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: not an identity", path)
+	}
+	private := ed25519.NewKeyFromSeed(seed)
+	id := &Identity{private.Public().(ed25519.PublicKey), private}
+	if !puzzleSolved(id.NodeID(), bits) {
+		return nil, fmt.Errorf("%s: identity doesn't solve a puzzle of %d bits", path, bits)
+	}
+	return id, nil
+}
+
+// The key and signature of a signed message. Messages embed it, and only To,
+// Nonce and Time are signed with them.
+type Signed struct {
+	PublicKey []byte
+	Signature []byte
+	To        ID    //the recipient, zero for a ping sent to an address
+	Nonce     ID    //fresh in a request, the one of the request in a response
+	Time      int64 //when it was signed, in Unix nanoseconds
+}
+
+func (s *Signed) signed() *Signed {
+	return s
+}
+
+type signable interface {
+	signed() *Signed
+}
+
+//msg as the recipient decodes it, gob drops empty slices so the sender
+//would otherwise sign [] where the recipient sees null
+func delivered(msg signable) (interface{}, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+		return nil, err
+	}
+	decoded := reflect.New(reflect.TypeOf(msg).Elem()).Interface()
+	return decoded, gob.NewDecoder(&buf).Decode(decoded)
+}
+
+//what is signed for msg sent as method
+func signedBytes(method string, msg signable) ([]byte, error) {
+	decoded, err := delivered(msg)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(decoded)
+	if err != nil {
+		return nil, err
+	}
+	s := msg.signed()
+	signed := append([]byte(method+"\x00"), s.To[:]...)
+	signed = append(signed, s.Nonce[:]...)
+	signed = binary.BigEndian.AppendUint64(signed, uint64(s.Time))
+	return append(signed, data...), nil
+}
+
+//sign msg sent as method to the node to at now with id's key, its nonce is
+//set by the caller
+func (id *Identity) sign(method string, msg signable, to ID, now time.Time) error {
+	s := msg.signed()
+	s.PublicKey, s.Signature = id.PublicKey, nil
+	s.To, s.Time = to, now.UnixNano()
+	data, err := signedBytes(method, msg)
+	if err != nil {
+		return err
+	}
+	s.Signature = ed25519.Sign(id.PrivateKey, data)
+	return nil
+}
+
+//check that msg sent as method was signed by the node nodeID, whose ID
+//solves the puzzle of bits bits
+func verifySignature(method string, msg signable, nodeID ID, bits int) error {
+	s := msg.signed()
+	if len(s.PublicKey) != ed25519.PublicKeySize || NodeIDFromKey(s.PublicKey) != nodeID || !puzzleSolved(nodeID, bits) {
+		return ErrBadSignature
+	}
+	data, err := signedBytes(method, msg)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(s.PublicKey, data, s.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// The nonces of the requests taken within SIGNATURE_WINDOW, by sender.
+type nonceCache struct {
+	mutex sync.Mutex
+	seen  map[nonceKey]time.Time //when each can be forgotten
+	swept time.Time
+}
+
+type nonceKey struct {
+	sender ID
+	nonce  ID
+}
+
+//whether the request nonce of sender, signed at signed, wasn't taken before
+func (c *nonceCache) fresh(sender ID, nonce ID, signed time.Time, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.seen == nil {
+		c.seen = make(map[nonceKey]time.Time)
+	}
+	if now.Sub(c.swept) > SIGNATURE_WINDOW {
+		for key, forget := range c.seen {
+			if now.After(forget) {
+				delete(c.seen, key)
+			}
+		}
+		c.swept = now
+	}
+	key := nonceKey{sender, nonce}
+	if _, ok := c.seen[key]; ok {
+		return false
+	}
+	//past that it is stale anyway
+	c.seen[key] = signed.Add(SIGNATURE_WINDOW)
+	return true
+}
+
+//check that the request msg sent as method was signed by sender for us,
+//recently, and that we haven't taken it before
+func (k *Kademlia) verifyRequest(method string, msg signable, sender ID) error {
+	if err := verifySignature(method, msg, sender, k.config.IDPuzzleBits); err != nil {
+		return err
+	}
+	s := msg.signed()
+	//a ping may be sent to an address whose node we don't know yet
+	if !s.To.Equals(k.NodeID) && !(method == "Ping" && s.To.Equals(ID{})) {
+		return ErrBadSignature
+	}
+	now := k.config.Clock.Now()
+	signed := time.Unix(0, s.Time)
+	if signed.Before(now.Add(-SIGNATURE_WINDOW)) || signed.After(now.Add(SIGNATURE_WINDOW)) {
+		return ErrStaleMessage
+	}
+	if !k.nonces.fresh(sender, s.Nonce, signed, now) {
+		return ErrStaleMessage
+	}
+	return nil
+}
+
+//check that the response msg to a request sent as method with nonce was
+//signed by the node nodeID, or by any node solving the puzzle when nodeID is
+//zero
+func (k *Kademlia) verifyResponse(method string, msg signable, nodeID ID, nonce ID) error {
+	s := msg.signed()
+	if nodeID.Equals(ID{}) {
+		nodeID = NodeIDFromKey(s.PublicKey)
+	}
+	if err := verifySignature(method+"Reply", msg, nodeID, k.config.IDPuzzleBits); err != nil {
+		return err
+	}
+	if !s.Nonce.Equals(nonce) || !s.To.Equals(k.NodeID) {
+		return ErrStaleMessage
+	}
+	return nil
+}
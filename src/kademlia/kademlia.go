@@ -5,8 +5,9 @@ package kademlia
 //Git Test
 
 import (
-	"container/list"
+	"context"
 	// "encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -30,18 +31,98 @@ const (
 	TOTAL_BUCKETS                 = 8 * IDBytes
 	MAX_BUCKET_SIZE               = 20
 	ALPHA                         = 3
-	TIME_INTERVAL   time.Duration = 1500 * time.Millisecond
-	RERPONSE_LIMIT  time.Duration = 1000 * time.Millisecond
+	RPC_TIMEOUT     time.Duration = 5 * time.Second
+	LOOKUP_TIMEOUT  time.Duration = 60 * time.Second
 )
 
+// Defaults of a node's Config.
+const (
+	DEFAULT_VALUE_TTL time.Duration = 8 * time.Hour
+	MAX_VALUE_TTL     time.Duration = 24 * time.Hour
+	SWEEP_INTERVAL    time.Duration = time.Minute
+
+	REPLICATE_INTERVAL time.Duration = time.Hour
+	REPUBLISH_INTERVAL time.Duration = 24 * time.Hour
+	REFRESH_INTERVAL   time.Duration = time.Hour
+)
+
+// Node policy. Values are stored for the TTL their sender asks for, or for
+// DefaultValueTTL when it asks for none, but never longer than MaxValueTTL.
+// Every ReplicateInterval the node copies the values it holds to the closest
+// nodes to their keys, and every RepublishInterval it stores again the values
+// it published itself. Buckets nobody looked up in for RefreshInterval are
+// refreshed with a lookup of a random ID in their range. OpenStore opens the
+// stores the node keeps its values and VDOs in. The Max limits on what other
+// nodes may store here are described in quota.go, 0 means no limit. Inbound
+// RPCs are limited to the Rate requests per second and Burst requests at once
+// per IP and per NodeID described in ratelimit.go, a Rate of 0 means no limit.
+// With VerifyNodeIDs set only peers whose NodeID is bound to their key, as
+// described in identity.go, are answered or added to the routing table, and
+// IDPuzzleBits is the puzzle their IDs must solve.
+type Config struct {
+	DefaultValueTTL   time.Duration
+	MaxValueTTL       time.Duration
+	SweepInterval     time.Duration
+	ReplicateInterval time.Duration
+	RepublishInterval time.Duration
+	RefreshInterval   time.Duration
+	Clock             Clock
+	OpenStore         StoreOpener
+	MaxValueSize      int
+	MaxStoreBytes     int64
+	MaxKeysPerSender  int
+	IPRequestRate     float64
+	IPRequestBurst    int
+	NodeRequestRate   float64
+	NodeRequestBurst  int
+	VerifyNodeIDs     bool
+	IDPuzzleBits      int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		DefaultValueTTL:   DEFAULT_VALUE_TTL,
+		MaxValueTTL:       MAX_VALUE_TTL,
+		SweepInterval:     SWEEP_INTERVAL,
+		ReplicateInterval: REPLICATE_INTERVAL,
+		RepublishInterval: REPUBLISH_INTERVAL,
+		RefreshInterval:   REFRESH_INTERVAL,
+		Clock:             realClock{},
+		OpenStore:         OpenMemoryStore,
+		MaxValueSize:      MAX_VALUE_SIZE,
+		MaxStoreBytes:     MAX_STORE_BYTES,
+		MaxKeysPerSender:  MAX_KEYS_PER_SENDER,
+		IPRequestRate:     IP_REQUEST_RATE,
+		IPRequestBurst:    IP_REQUEST_BURST,
+		NodeRequestRate:   NODE_REQUEST_RATE,
+		NodeRequestBurst:  NODE_REQUEST_BURST,
+	}
+}
+
 // Kademlia type. You can put whatever state you need in this.
 type Kademlia struct {
 	NodeID      ID
 	SelfContact Contact
-	buckets     [IDBytes * 8]*list.List
-	storeMutex  sync.RWMutex
-	storeMap    map[ID][]byte
-	vdoMap      map[ID]VanashingDataObject
+	identity    *Identity //nil when NodeID is not bound to a key
+	nonces      nonceCache
+	table       *RoutingTable
+	values      Store
+	quota       *storeQuota
+	published   Store
+	vdos        Store
+	pool        *clientPool
+	listener    *trackingListener
+	ipLimiter   *rateLimiter
+	nodeLimiter *rateLimiter
+	counters    *rpcCounters
+	confirming  confirmations
+	config      Config
+	done        chan struct{}
+	closeOnce   sync.Once
+
+	//when each bucket was last looked up in
+	lookupMutex   sync.Mutex
+	bucketLookups [IDBytes * 8]time.Time
 }
 
 type ContactDistance struct {
@@ -51,101 +132,83 @@ type ContactDistance struct {
 
 type ByDistance []ContactDistance
 
-type Stopper struct {
-	stopMutex sync.RWMutex
-	value     int
-	//0: No stop
-	//1: Have accumulate k active
-	//2: No improve in shortlist
-	//3: Found value
-}
-
-type Counter struct {
-	counterMutex sync.RWMutex
-	value        int
-}
-
-type Valuer struct {
-	value  []byte
-	NodeID ID
-}
-
-type ReturnValuer struct {
-	returnedValueMap    map[ID]bool
-	value               []byte
-	returnedValuerMutex sync.RWMutex
-}
-
-type UnqueriedList struct {
-	list  []ContactDistance
-	mutex sync.RWMutex
-}
-
-type ResultShortlist struct {
-	list  []Contact
-	mutex sync.RWMutex
-}
-
-//CHECK IF UNQUERIED LIST IS IMPROVED
-type CheckImproved struct {
-	value bool
-	mutex sync.RWMutex
-}
-
-type QueryWaitList struct {
-	waitList       []ContactDistance
-	queryListMutex sync.RWMutex
+//vanish
+func (k *Kademlia) DoVanishData(vdoid ID, data []byte, N byte, threshold byte, validPeriod int) string {
+	vdo, err := VanishData(context.Background(), k, data, N, threshold, validPeriod)
+	if err != nil {
+		return err.Error()
+	}
+	data, err = MarshalVDO(vdo)
+	if err != nil {
+		return err.Error()
+	}
+	if err := k.vdos.Put(vdoid, StoreEntry{Value: data}); err != nil {
+		return err.Error()
+	}
+	return "ok"
 }
 
-type ShortestDistance struct {
-	shortDistanceMutex sync.RWMutex
-	Distance           ID
-	selfContact        Contact
+func NewKademlia(nodeid ID, laddr string) *Kademlia {
+	return NewKademliaWithConfig(nodeid, laddr, DefaultConfig())
 }
 
-type Contacter struct {
-	selfContact Contact
-	contactList []Contact
+// Start a node with a NodeID not bound to a key, it signs nothing so its
+// peers must not verify NodeIDs.
+func NewKademliaWithConfig(nodeid ID, laddr string, config Config) *Kademlia {
+	return newKademlia(nodeid, nil, laddr, config)
 }
 
-//vanish
-func (k *Kademlia) DoVanishData(vdoid ID, data []byte, N byte, threshold byte, validPeriod int) string {
-	vdo := VanishData(*k, data, N, threshold, validPeriod)
-	if len(vdo.Ciphertext) == 0 {
-		return "vdo is nil"
-	}
-	k.storeMutex.Lock()
-	k.vdoMap[vdoid] = vdo
-	k.storeMutex.Unlock()
-	return "ok"
+// Start a node whose NodeID is the one of identity.
+func NewKademliaWithIdentity(identity *Identity, laddr string, config Config) *Kademlia {
+	return newKademlia(identity.NodeID(), identity, laddr, config)
 }
 
-func NewKademlia(nodeid ID, laddr string) *Kademlia {
+func newKademlia(nodeid ID, identity *Identity, laddr string, config Config) *Kademlia {
 	// TODO: Initialize other state here as you add functionality.
 	k := new(Kademlia)
 	k.NodeID = nodeid
-	for i := 0; i < len(k.buckets); i++ {
-		k.buckets[i] = list.New()
-	}
-
-	// make message map
-	k.storeMap = make(map[ID][]byte)
-	k.vdoMap = make(map[ID]VanashingDataObject)
-
-	s := rpc.NewServer() // Create a new RPC server
-	s.Register(&KademliaCore{k})
-	_, port, _ := net.SplitHostPort(laddr)                           // extract just the port number
-	s.HandleHTTP(rpc.DefaultRPCPath+port, rpc.DefaultDebugPath+port) // I'm making a unique RPC path for this instance of Kademlia
+	k.identity = identity
+	k.config = config
+	k.done = make(chan struct{})
+	k.table = NewRoutingTable(nodeid)
+
+	// open the stores
+	openStore := func(name string) Store {
+		store, err := config.OpenStore(name)
+		if err != nil {
+			log.Fatal("Open store: ", err)
+		}
+		return store
+	}
+	k.values = openStore(STORE_VALUES)
+	k.quota = newStoreQuota(k.values)
+	k.published = openStore(STORE_PUBLISHED)
+	k.vdos = openStore(STORE_VDOS)
+	k.pool = newClientPool()
+	k.ipLimiter = newRateLimiter(config.IPRequestRate, config.IPRequestBurst, config.Clock)
+	k.nodeLimiter = newRateLimiter(config.NodeRequestRate, config.NodeRequestBurst, config.Clock)
+	k.counters = newRPCCounters()
+	k.confirming.pending = make(map[ID]bool)
 
 	l, err := net.Listen("tcp", laddr)
 	if err != nil {
 		log.Fatal("Listen: ", err)
 	}
-	// Run RPC server forever.
-	go http.Serve(l, nil)
+	// Use the port we actually got, laddr may ask for any free port
+	hostname, port, _ := net.SplitHostPort(l.Addr().String())
+
+	s := rpc.NewServer() // Create a new RPC server
+	s.Register(&KademliaCore{k})
+	// Each node serves its own mux, so a node started on the port of a closed
+	// one can register its path again
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath+port, rpcHandler{s, k}) // I'm making a unique RPC path for this instance of Kademlia
+
+	// Run RPC server until the node is closed.
+	k.listener = newTrackingListener(l)
+	go http.Serve(k.listener, mux)
 
 	// Add self contact
-	hostname, port, _ := net.SplitHostPort(l.Addr().String())
 	port_int, _ := strconv.Atoi(port)
 	ipAddrStrings, err := net.LookupHost(hostname)
 	var host net.IP
@@ -157,9 +220,23 @@ func NewKademlia(nodeid ID, laddr string) *Kademlia {
 	}
 	// fmt.Println("new : " + host.String())
 	k.SelfContact = Contact{k.NodeID, host, uint16(port_int)}
+
+	go k.every(k.config.SweepInterval, k.sweepValues)
+	go k.every(k.config.ReplicateInterval, k.replicateValues)
+	go k.every(k.config.RepublishInterval, k.republishValues)
+	go k.every(k.config.RefreshInterval, k.refreshStaleBuckets)
+	go k.every(k.config.SweepInterval, k.pruneRateLimiters)
 	return k
 }
 
+// Errors returned by the typed API. Errors caused by a peer wrap
+// ErrUnreachable or ErrTimeout, check them with errors.Is.
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrTimeout     = errors.New("timed out")
+	ErrUnreachable = errors.New("peer unreachable")
+)
+
 type NotFoundError struct {
 	id  ID
 	msg string
@@ -169,134 +246,80 @@ func (e *NotFoundError) Error() string {
 	return fmt.Sprintf("%x %s", e.id, e.msg)
 }
 
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
 func (k *Kademlia) FindContact(nodeId ID) (*Contact, error) {
 	// Find contact with provided ID
 	if nodeId == k.SelfContact.NodeID {
 		return &k.SelfContact, nil
 	}
-	bucket := k.FindBucket(nodeId)
-	if bucket == nil {
-		return nil, &NotFoundError{nodeId, "Not found"}
-	}
-	res, err := k.FindContactInBucket(nodeId, bucket)
-	if err == nil {
-		c := res.Value.(Contact)
+	if c, ok := k.table.Find(nodeId); ok {
 		return &c, nil
 	}
 	return nil, &NotFoundError{nodeId, "Not found"}
 }
 
-//DoUnVanishData
-func (k *Kademlia) DoUnVanishData(contact *Contact, searchVodId ID) string {
-	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
-
-	// client, err := rpc.DialHTTP("tcp", contact.Host.String()+":"+strconv.Itoa(int(contact.Port)))
-	client, err := rpc.DialHTTPPath("tcp", contact.Host.String()+":"+strconv.Itoa(int(contact.Port)), rpc.DefaultRPCPath+strconv.Itoa(int(contact.Port)))
-
-	if err != nil {
-
-		return err.Error()
-	}
-
-	//create find node request and result
-	getVDORequest := new(GetVDORequest)
-	getVDORequest.Sender = k.SelfContact
-	getVDORequest.MsgID = NewRandomID()
-	getVDORequest.VdoID = searchVodId
-
-	getVDOResult := new(GetVDOResult)
+///////////////////////////////////////////////////////////////////////////////
+// typed API, the Do* functions below format these for the console
+///////////////////////////////////////////////////////////////////////////////
 
-	//find node
-	err = client.Call("KademliaCore.GetVDO", getVDORequest, getVDOResult)
+// Ping host:port and return the contact that answered.
+func (k *Kademlia) Ping(ctx context.Context, host net.IP, port uint16) (Contact, error) {
+	sender, err := k.ping(ctx, host, port)
 	if err != nil {
-		return err.Error()
-	}
-
-	vdoRes := getVDOResult.VDO
-
-	data := UnvanishData(*k, vdoRes)
-
-	if len(data) != 0 {
-		result := string(data[:])
-
-		return "ok, Unvanish result is: " + result
-	} else {
-		return "No Record"
+		return Contact{}, err
 	}
+	k.UpdateContact(sender)
+	return sender, nil
 }
 
-// This is the function to perform the RPC
-func (k *Kademlia) DoPing(host net.IP, port uint16) string {
+//ping without adding the peer to our contacts
+func (k *Kademlia) ping(ctx context.Context, host net.IP, port uint16) (Contact, error) {
+	return k.sendPing(ctx, host, port, false)
+}
 
+func (k *Kademlia) sendPing(ctx context.Context, host net.IP, port uint16, confirm bool) (Contact, error) {
 	var ping PingMessage
 	ping.MsgID = NewRandomID()
 	ping.Sender = k.SelfContact
-
-	// fmt.Println("***IN DO ping: " + k.SelfContact.Host.String())
+	ping.Confirm = confirm
 
 	var pong PongMessage
-	// client, err := rpc.DialHTTP("tcp", string(host) + ":" + string(port))
-	// client, err := rpc.DialHTTP("tcp", host.String()+":"+strconv.Itoa(int(port)))
-	client, err := rpc.DialHTTPPath("tcp", host.String()+":"+strconv.Itoa(int(port)), rpc.DefaultRPCPath+strconv.Itoa(int(port)))
-
-	if err != nil {
-		log.Fatal("DialHTTP: ", err)
+	//we may not know who is at host:port, the pong is signed by the node it
+	//claims to come from
+	if err := k.call(ctx, Contact{Host: host, Port: port}, "Ping", &ping, &pong); err != nil {
+		return Contact{}, err
 	}
-	err = client.Call("KademliaCore.Ping", ping, &pong)
-
-	if err != nil {
-		return "ERR: " + err.Error()
+	if k.config.VerifyNodeIDs && !NodeIDFromKey(pong.PublicKey).Equals(pong.Sender.NodeID) {
+		return Contact{}, ErrBadSignature
 	}
-
-	defer client.Close()
-	k.UpdateContact(pong.Sender)
-
-	return "ok"
+	return pong.Sender, nil
 }
 
-func (k *Kademlia) DoStore(contact *Contact, key ID, value []byte) string {
+// Store value on contact for ttl, 0 lets contact pick its default TTL. The
+// error matches ErrStoreRefused when contact refused the value.
+func (k *Kademlia) Store(ctx context.Context, contact *Contact, key ID, value []byte, ttl time.Duration) error {
 	//create store request and result
 	storeRequest := new(StoreRequest)
 	storeRequest.MsgID = NewRandomID()
 	storeRequest.Sender = k.SelfContact
 	storeRequest.Key = key
 	storeRequest.Value = value
+	storeRequest.TTL = ttl
 
 	storeResult := new(StoreResult)
-
-	// store
-	// rpc.DialHTTP("tcp", host.String() + ":" + strconv.Itoa(int(port)))
-	// client, err := rpc.DialHTTP("tcp", contact.Host.String()+":"+strconv.Itoa(int(contact.Port)))
-	client, err := rpc.DialHTTPPath("tcp", contact.Host.String()+":"+strconv.Itoa(int(contact.Port)), rpc.DefaultRPCPath+strconv.Itoa(int(contact.Port)))
-
-	if err != nil {
-		return err.Error()
-	}
-
-	err = client.Call("KademliaCore.Store", storeRequest, storeResult)
-
-	//check error
-	if err != nil {
-		return err.Error()
+	if err := k.call(ctx, *contact, "Store", storeRequest, storeResult); err != nil {
+		k.contactFailed(*contact, err)
+		return err
 	}
-	//n := bytes.Index(value, []byte{0})
-	fmt.Println("Store " + "key:" + key.AsString() + "Value: " + string(value[:len(value)-1]) + "len: " + strconv.Itoa(len(value)) + " to " + contact.NodeID.AsString() + " Successfully")
-	k.UpdateContact(*contact)
-	defer client.Close()
-	return "ok"
+	k.learnContact(*contact)
+	return storeResult.Err
 }
 
-func (k *Kademlia) DoFindNode(contact *Contact, searchKey ID) string {
-	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
-
-	// client, err := rpc.DialHTTP("tcp", contact.Host.String()+":"+strconv.Itoa(int(contact.Port)))
-	client, err := rpc.DialHTTPPath("tcp", contact.Host.String()+":"+strconv.Itoa(int(contact.Port)), rpc.DefaultRPCPath+strconv.Itoa(int(contact.Port)))
-
-	if err != nil {
-
-		return err.Error()
-	}
-
+// Ask contact for the nodes it knows closest to searchKey.
+func (k *Kademlia) FindNode(ctx context.Context, contact *Contact, searchKey ID) ([]Contact, error) {
 	//create find node request and result
 	findNodeRequest := new(FindNodeRequest)
 	findNodeRequest.Sender = k.SelfContact
@@ -304,35 +327,28 @@ func (k *Kademlia) DoFindNode(contact *Contact, searchKey ID) string {
 	findNodeRequest.NodeID = searchKey
 
 	findNodeRes := new(FindNodeResult)
-
-	//find node
-	err = client.Call("KademliaCore.FindNode", findNodeRequest, findNodeRes)
-	if err != nil {
-		return err.Error()
+	if err := k.call(ctx, *contact, "FindNode", findNodeRequest, findNodeRes); err != nil {
+		k.contactFailed(*contact, err)
+		return nil, err
 	}
 
 	//update contact
-	var res string
-	for _, contact := range findNodeRes.Nodes {
-		k.UpdateContact(contact)
-	}
-
-	res = k.ContactsToString(findNodeRes.Nodes)
-	if res == "" {
-		return "No Record"
+	k.learnContact(*contact)
+	for _, c := range findNodeRes.Nodes {
+		k.learnContact(c)
 	}
-	return "ok, result is: " + res
+	return findNodeRes.Nodes, nil
 }
 
-func (k *Kademlia) DoFindValue(contact *Contact, searchKey ID) string {
-	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
-	// client, err := rpc.DialHTTP("tcp", contact.Host.String()+":"+strconv.Itoa(int(contact.Port)))
-	client, err := rpc.DialHTTPPath("tcp", contact.Host.String()+":"+strconv.Itoa(int(contact.Port)), rpc.DefaultRPCPath+strconv.Itoa(int(contact.Port)))
-
-	if err != nil {
-		return err.Error()
-	}
+// Ask contact for the value of searchKey. If it doesn't have it the value is
+// nil and the contacts are the closest nodes it knows.
+func (k *Kademlia) FindValue(ctx context.Context, contact *Contact, searchKey ID) ([]byte, []Contact, error) {
+	findValueRes, err := k.findValue(ctx, contact, searchKey)
+	return findValueRes.Value, findValueRes.Nodes, err
+}
 
+//FindValue with the value's remaining TTL at contact
+func (k *Kademlia) findValue(ctx context.Context, contact *Contact, searchKey ID) (FindValueResult, error) {
 	//create find value request and result
 	findValueReq := new(FindValueRequest)
 	findValueReq.Sender = k.SelfContact
@@ -340,732 +356,308 @@ func (k *Kademlia) DoFindValue(contact *Contact, searchKey ID) string {
 	findValueReq.Key = searchKey
 
 	findValueRes := new(FindValueResult)
-
-	//find value
-	err = client.Call("KademliaCore.FindValue", findValueReq, findValueRes)
-
-	if err != nil {
-		return err.Error()
+	if err := k.call(ctx, *contact, "FindValue", findValueReq, findValueRes); err != nil {
+		k.contactFailed(*contact, err)
+		return FindValueResult{}, err
 	}
 
-	defer client.Close()
-
 	//update contact
-	k.UpdateContact(*contact)
-
-	var res string
-	//if value if found return value, else return closest contacts
-	if findValueRes.Value != nil {
-		res = res + string(findValueRes.Value[:])
-	} else {
-		res = res + k.ContactsToString(findValueRes.Nodes)
-	}
-	if res == "" {
-		return "No Record"
+	k.learnContact(*contact)
+	for _, c := range findValueRes.Nodes {
+		k.learnContact(c)
 	}
-	return "ok, result is: " + res
+	return *findValueRes, nil
 }
 
-func (k *Kademlia) LocalFindValue(searchKey ID) string {
-	// TODO: Implement
-	k.storeMutex.Lock()
-	value, ok := k.storeMap[searchKey]
-	k.storeMutex.Unlock()
-	if ok {
-		return "OK:" + string(value[:])
-	} else {
-		return "ERR: Not implemented"
+func (k *Kademlia) LocalValue(searchKey ID) ([]byte, error) {
+	value, _, ok := k.localValue(searchKey)
+	if !ok {
+		return nil, ErrNotFound
 	}
-	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
+	return value, nil
 }
 
-func (k *Kademlia) DoIterativeFindNode(id ID) string {
-
-	shortlist := k.IterativeFindNode(id)
-	// shortcontacts := FindClosestContactsBySort(shortlist)
-	return k.ContactsToString(shortlist)
+// Store value on the closest nodes to key for ttl, returns the nodes that
+// took it. This node republishes the value until ttl has passed.
+func (k *Kademlia) IterativeStore(ctx context.Context, key ID, value []byte, ttl time.Duration) ([]Contact, error) {
+	k.publish(key, value, ttl)
+	return k.storeClosest(ctx, key, value, ttl)
 }
 
-func (k *Kademlia) IterativeFindNode(id ID) []Contact {
-
-	// store active nodes(queried)
-	shortlist := make(chan Contact, MAX_BUCKET_SIZE)
-
-	//node that we have seen
-	seenMap := make(map[ID]bool)
-
-	//nodes that have not been queried yet
-	unqueriedList := new(UnqueriedList)
-	unqueriedList.list = make([]ContactDistance, 0)
-
-	//channel for query result
-	res := make(chan []Contact, 120)
-
-	//stopper for rpc request
-	stopper := new(Stopper)
-
-	//initialize shortlist, seenmap
-	initializeContacts := k.FindClosestContacts(id, k.NodeID)
-	if len(initializeContacts) > ALPHA {
-		initializeContacts = initializeContacts[:3]
+//store value on the closest nodes to key for ttl. Each node that refuses it
+//is replaced by the next closest node we know.
+func (k *Kademlia) storeClosest(ctx context.Context, key ID, value []byte, ttl time.Duration) ([]Contact, error) {
+	contactList, err := k.IterativeFindNode(ctx, key)
+	if err != nil && len(contactList) == 0 {
+		return nil, err
 	}
-
-	//result to return
-	resultShortlist := new(ResultShortlist)
-
-	//global closest
-	closest := k.SelfContact.NodeID.Xor(id)
-
-	//check if unqueried list is improved
-	checkImproved := new(CheckImproved)
-	checkImproved.value = true
-
-	//stop channel for time
-	stop := make(chan bool, 100)
-
-	//initialize unqueriedlist and seenmap
-	for i := 0; i < ALPHA && i < len(initializeContacts); i++ {
-		contact := initializeContacts[i]
-		seenMap[contact.NodeID] = true
-		unqueriedList.list = append(unqueriedList.list, k.ContactToDistanceContact(contact, id))
+	tried := make(map[ID]bool, len(contactList))
+	for _, c := range contactList {
+		tried[c.NodeID] = true
 	}
-
-	// fmt.Println(".........find closet contact.........")
-	// fmt.Println(k.ContactsToString(k.FindClosestContacts(id, k.NodeID)))
-
-	// fmt.Println(".........find closet contact.........")
-	// fmt.Println(k.ContactsToString(initializeContacts))
-
-	//add res to shortlist
-	go func() {
-		for {
-			select {
-			case contacts := <-res:
-				tempContacts := make([]ContactDistance, 0)
-				for _, contact := range contacts {
-					if _, ok := seenMap[contact.NodeID]; ok == false {
-						tempContacts = append(tempContacts, k.ContactToDistanceContact(contact, id))
-						seenMap[contact.NodeID] = true
-					}
-				}
-
-				//append closest node and sort
-				unqueriedList.mutex.Lock()
-				unqueriedList.list = append(unqueriedList.list, tempContacts...)
-				sort.Sort(ByDistance(unqueriedList.list))
-				// fmt.Println("unqueried list")
-				// fmt.Println(k.FindClosestContactsBySort(unqueriedList.list))
-				unqueriedList.mutex.Unlock()
-
-				//check if unqueried is improved,
-				checkImproved.mutex.RLock()
-				ifImproved := checkImproved.value
-				checkImproved.mutex.RUnlock()
-
-				if ifImproved == true {
-					unqueriedList.mutex.RLock()
-					unqueriedListLength := len(unqueriedList.list)
-					var firstElement ContactDistance
-					if unqueriedListLength > 0 {
-						firstElement = unqueriedList.list[0]
-					}
-					unqueriedList.mutex.RUnlock()
-
-					//check if improved
-					if unqueriedListLength != 0 && firstElement.SelfContact.NodeID.Xor(id).Compare(closest) == 1 {
-						checkImproved.mutex.Lock()
-						checkImproved.value = false
-						checkImproved.mutex.Unlock()
-					} else if unqueriedListLength != 0 && firstElement.SelfContact.NodeID.Xor(id).Compare(closest) != 1 {
-						closest = firstElement.SelfContact.NodeID.Xor(id)
-					}
-
-					if unqueriedListLength == 0 {
-						if len(res) == 0 {
-							stopper.stopMutex.Lock()
-							stopper.value = 2
-							stopper.stopMutex.Unlock()
-							stop <- true
-							break
-						} else {
-							continue
-						}
-					}
-				}
-			default:
-			}
-		}
-	}()
-
-	for {
-		// check if unqueried list is empty and if there response in flight
-		unqueriedList.mutex.RLock()
-		tempLength := len(unqueriedList.list)
-		unqueriedList.mutex.RUnlock()
-
-		if tempLength == 0 {
-			time.Sleep(TIME_INTERVAL)
-			unqueriedList.mutex.RLock()
-			tempLength = len(unqueriedList.list)
-			unqueriedList.mutex.RUnlock()
-
-			if len(res) == 0 && tempLength == 0 {
-				stop <- true
-				break
+	var spares []Contact
+	stored := make([]Contact, 0, len(contactList))
+	var lastErr error
+	for i := 0; i < len(contactList); i++ {
+		err := k.Store(ctx, &contactList[i], key, value, ttl)
+		if errors.Is(err, ErrStoreRefused) {
+			if spares == nil {
+				spares = k.table.Closest(key, k.NodeID, 2*MAX_BUCKET_SIZE)
 			}
-		}
-
-		// alpha query
-		for i := 0; i < ALPHA; i++ {
-			//check if unqueried list is empty
-			unqueriedList.mutex.RLock()
-			unqueriedListLength := len(unqueriedList.list)
-			unqueriedList.mutex.RUnlock()
-			if unqueriedListLength == 0 {
-				break
+			for len(spares) > 0 && tried[spares[0].NodeID] {
+				spares = spares[1:]
 			}
-
-			unqueriedList.mutex.RLock()
-			front := unqueriedList.list[0]
-			unqueriedList.mutex.RUnlock()
-
-			//check if end
-			stopper.stopMutex.RLock()
-			stopperValue := stopper.value
-			stopper.stopMutex.RUnlock()
-
-			if stopperValue != 0 {
-				break
+			if len(spares) > 0 {
+				tried[spares[0].NodeID] = true
+				contactList = append(contactList, spares[0])
+				spares = spares[1:]
 			}
-
-			//get first contact from unqueriedList
-			test := make([]Contact, 0)
-			test = append(test, front.SelfContact)
-			//remove this contact
-			unqueriedList.mutex.Lock()
-			unqueriedList.list = unqueriedList.list[1:]
-			unqueriedList.mutex.Unlock()
-
-			//type contact
-			contact := front.SelfContact
-
-			go func() {
-				err, response := k.rpcQuery(contact, id, res)
-
-				if err == nil {
-
-					// add this active node to shortlist
-					shortlist <- contact
-
-					if len(shortlist) >= MAX_BUCKET_SIZE {
-						stopper.stopMutex.Lock()
-						stopper.value = 1
-						stopper.stopMutex.Unlock()
-						stop <- true
-						return
-					}
-
-					//if is improved add the response to the res
-					checkImproved.mutex.RLock()
-					if checkImproved.value == true {
-						res <- response
-					}
-					checkImproved.mutex.RUnlock()
-				}
-			}()
 		}
-		select {
-
-		case <-time.After(TIME_INTERVAL):
-		case <-stop:
-			if len(shortlist) == MAX_BUCKET_SIZE || len(res) == 0 {
-				resultShortlist.mutex.Lock()
-				resultShortlist.list = make([]Contact, len(shortlist))
-				channelLength := len(shortlist)
-				for i := 0; i < channelLength; i++ {
-					resultShortlist.list[i] = <-shortlist
-				}
-				resultShortlist.mutex.Unlock()
-				return resultShortlist.list
-			}
-			break
-		default:
+		if err != nil {
+			lastErr = err
+			continue
 		}
+		stored = append(stored, contactList[i])
 	}
-
-	//make sure that res is flushed to the shortlist
-
-	for {
-		if len(shortlist) == MAX_BUCKET_SIZE || len(res) == 0 {
-			break
+	if len(stored) == 0 {
+		if lastErr == nil {
+			lastErr = ErrNotFound
 		}
+		return nil, lastErr
 	}
+	return stored, nil
+}
+
+// Fetch a VDO from the node that created it.
+func (k *Kademlia) GetVDO(ctx context.Context, contact *Contact, vdoID ID) (VanashingDataObject, error) {
+	getVDORequest := new(GetVDORequest)
+	getVDORequest.Sender = k.SelfContact
+	getVDORequest.MsgID = NewRandomID()
+	getVDORequest.VdoID = vdoID
 
-	//return shortlist
-	resultShortlist.mutex.Lock()
-	resultShortlist.list = make([]Contact, len(shortlist))
-	channelLength := len(shortlist)
-	for i := 0; i < channelLength; i++ {
-		resultShortlist.list[i] = <-shortlist
+	getVDOResult := new(GetVDOResult)
+	if err := k.call(ctx, *contact, "GetVDO", getVDORequest, getVDOResult); err != nil {
+		return VanashingDataObject{}, err
+	}
+	if len(getVDOResult.VDO.Ciphertext) == 0 {
+		return VanashingDataObject{}, ErrNotFound
 	}
-	resultShortlist.mutex.Unlock()
-	return resultShortlist.list
+	return getVDOResult.VDO, nil
 }
 
-//rpc query for iterativefindnode
-func (k *Kademlia) rpcQuery(node Contact, searchId ID, res chan []Contact) (error, []Contact) {
-	client, err := rpc.DialHTTPPath("tcp", node.Host.String()+":"+strconv.Itoa(int(node.Port)), rpc.DefaultRPCPath+strconv.Itoa(int(node.Port)))
-	// client, err := rpc.DialHTTP("tcp", node.Host.String()+":"+strconv.Itoa(int(node.Port)))
-
+// Fetch a VDO from the node that created it and unvanish it.
+func (k *Kademlia) UnvanishVDO(ctx context.Context, contact *Contact, vdoID ID) ([]byte, error) {
+	vdo, err := k.GetVDO(ctx, contact, vdoID)
 	if err != nil {
-		return err, nil
+		return nil, err
 	}
+	return UnvanishData(ctx, k, vdo)
+}
 
-	//create find node request and result
-	findNodeRequest := new(FindNodeRequest)
-	findNodeRequest.Sender = k.SelfContact
-	findNodeRequest.MsgID = NewRandomID()
-	findNodeRequest.NodeID = searchId
-
-	findNodeRes := new(FindNodeResult)
+///////////////////////////////////////////////////////////////////////////////
+// console API, these never wait longer than RPC_TIMEOUT for a single RPC or
+// LOOKUP_TIMEOUT for one iterative lookup
+///////////////////////////////////////////////////////////////////////////////
 
-	//find node
-	err = client.Call("KademliaCore.FindNode", findNodeRequest, findNodeRes)
+func lookupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), LOOKUP_TIMEOUT)
+}
 
+//DoUnVanishData
+func (k *Kademlia) DoUnVanishData(contact *Contact, searchVodId ID) string {
+	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
+	data, err := k.UnvanishVDO(context.Background(), contact, searchVodId)
+	if errors.Is(err, ErrNotFound) {
+		return "No Record"
+	}
 	if err != nil {
-		return err, nil
+		return "ERR: " + err.Error()
 	}
 
-	defer client.Close()
+	if len(data) != 0 {
+		result := string(data[:])
 
-	//update contact
-	k.UpdateContact(node)
-	for _, contact := range findNodeRes.Nodes {
-		k.UpdateContact(contact)
+		return "ok, Unvanish result is: " + result
+	} else {
+		return "No Record"
 	}
-
-	return err, findNodeRes.Nodes
 }
 
-func (k *Kademlia) DoIterativeStore(key ID, value []byte) string {
-	// For project 2!
-	contactList := k.IterativeFindNode(key)
-	var result string
-	for _, contact := range contactList {
-		res := k.DoStore(&contact, key, value)
-		if res == "ok" {
-			result = result + "NodeId" + contact.NodeID.AsString()
-		}
+// This is the function to perform the RPC
+func (k *Kademlia) DoPing(host net.IP, port uint16) string {
+	if _, err := k.Ping(context.Background(), host, port); err != nil {
+		return "ERR: " + err.Error()
 	}
-	return result
+	return "ok"
 }
-func (k *Kademlia) DoIterativeFindValue(key ID) string {
-	// fmt.Println("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~Come in to Iterative Find Value~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
-	// For project 2!
-	shortList := make(chan Contact, MAX_BUCKET_SIZE)
-
-	//node that we have seen
-	seenMap := make(map[ID]bool)
-	//returnedValueMap := make(map[ID]bool)
-
-	returnValuer := new(ReturnValuer)
-	returnValuer.returnedValueMap = make(map[ID]bool)
-	//nodes that have not been queried yet
-	queryWaitList := new(QueryWaitList)
-	queryWaitList.waitList = make([]ContactDistance, 0)
-
-	//init the stopper
-	stopper := new(Stopper)
-	stopper.value = 0
-
-	//init CloestNode
-	clostestNode := new(ShortestDistance)
-	for i := 0; i < IDBytes; i++ {
-		clostestNode.Distance[i] = uint8(255)
-	}
-	var clostestNodeImproved bool
-	clostestNodeImproved = true
-
-	// contactChan := make(chan []Contact, MAX_BUCKET_SIZE*MAX_BUCKET_SIZE*2)
-	contactChan := make(chan Contacter, MAX_BUCKET_SIZE*3)
-	valueChan := make(chan Valuer, MAX_BUCKET_SIZE*3)
-	stop := make(chan bool, MAX_BUCKET_SIZE)
-
-	//initialize
-	var returnValue []byte
-	contacts := k.FindClosestContacts(key, k.NodeID)
-	if len(contacts) > 3 {
-		contacts = contacts[:ALPHA]
-	}
-	for _, contact := range contacts {
-		seenMap[contact.NodeID] = true
-		queryWaitList.queryListMutex.Lock()
-		queryWaitList.waitList = append(queryWaitList.waitList, k.ContactToDistanceContact(contact, key))
-		queryWaitList.queryListMutex.Unlock()
 
+func (k *Kademlia) DoStore(contact *Contact, key ID, value []byte) string {
+	if err := k.Store(context.Background(), contact, key, value, 0); err != nil {
+		return err.Error()
 	}
+	return "ok"
+}
 
-	go func() {
-		for {
-			select {
-			case contacter := <-contactChan:
-				//fmt.Println("ShortList Active Incoming")
-				contacts := contacter.contactList
-				activeContact := contacter.selfContact
-				shortList <- activeContact
-				if len(shortList) == MAX_BUCKET_SIZE {
-					stopper.stopMutex.Lock()
-					stopper.value = 1
-					stopper.stopMutex.Unlock()
-					stop <- true
-					return
-				}
-				if clostestNodeImproved && len(contacts) > 0 {
-					for _, contact := range contacts {
-						if _, ok := seenMap[contact.NodeID]; ok == false {
-							queryWaitList.queryListMutex.Lock()
-							//fmt.Println("Add into querywaitlist")
-							queryWaitList.waitList = append(queryWaitList.waitList, k.ContactToDistanceContact(contact, key))
-							queryWaitList.queryListMutex.Unlock()
-							seenMap[contact.NodeID] = true
-						}
-					}
-					//sort shortlist
-					queryWaitList.queryListMutex.Lock()
-					sort.Sort(ByDistance(queryWaitList.waitList))
-					if len(queryWaitList.waitList) == 0 {
-						//fmt.Println("not improve because wait list length is 0!!!!!!!!!!!!!")
-						clostestNodeImproved = false
-						queryWaitList.queryListMutex.Unlock()
-						break
-					}
-					clostestTemp := queryWaitList.waitList[0]
-					distanceTemp := clostestTemp.Distance
-					queryWaitList.queryListMutex.Unlock()
-					//check if short list is improved
-					clostestNode.shortDistanceMutex.Lock()
-					if clostestNode.Distance.Compare(clostestNode.Distance) == 1 {
-						//fmt.Println("not improve because no close!!!!!!!!!!!!!!!!!!!!!!!")
-						clostestNodeImproved = false
-					} else {
-						clostestNode.Distance = distanceTemp
-						clostestNode.selfContact = clostestTemp.SelfContact
-					}
-					clostestNode.shortDistanceMutex.Unlock()
-				}
-			case valuer := <-valueChan:
-				//fmt.Println("Value returned")
-				//returnValue = valuer.value
-				returnValuer.returnedValuerMutex.Lock()
-				returnValuer.returnedValueMap[valuer.NodeID] = true
-				returnValuer.value = valuer.value
-				returnValuer.returnedValuerMutex.Unlock()
-				//returnedValueMap[valuer.NodeID] = true
-				stopper.stopMutex.Lock()
-				stopper.value = 3
-				stopper.stopMutex.Unlock()
-				stop <- true
-				return
-			default:
-
-			}
-		}
-	}()
-
-	//stop channel for time
-HandleLoop:
-	for {
-		//fmt.Println("Dead here 1")
-		queryWaitList.queryListMutex.RLock()
-		querylistLen := len(queryWaitList.waitList)
-		queryWaitList.queryListMutex.RUnlock()
-		//fmt.Println("Dead here 1.1")
-
-		//Important here
-		if len(contactChan) == 0 && len(valueChan) == 0 {
-			time.Sleep(TIME_INTERVAL)
-			if querylistLen == 0 {
-				//fmt.Println("Dead here 2")
-				stopper.stopMutex.Lock()
-				stopper.value = 2
-				stopper.stopMutex.Unlock()
-				// fmt.Println("Set the stop")
-				stop <- true
-			}
-		}
-		queryWaitList.queryListMutex.Lock()
-		sort.Sort(ByDistance(queryWaitList.waitList))
-		queryWaitList.queryListMutex.Unlock()
-		//fmt.Println("Dead here 1.2")
-
-		for i := 0; i < ALPHA && querylistLen > 0; i++ {
-			//check if end
-			//fmt.Println("Dead here 3")
-
-			stopper.stopMutex.RLock()
-			if stopper.value != 0 {
-				break
-			}
-			stopper.stopMutex.RUnlock()
-			queryWaitList.queryListMutex.Lock()
-			contact := queryWaitList.waitList[0].SelfContact
-			queryWaitList.waitList = queryWaitList.waitList[1:]
-			querylistLen = len(queryWaitList.waitList)
-			queryWaitList.queryListMutex.Unlock()
-
-			go func() {
-				fmt.Println("Sent a RPC")
-				k.iterFindValuQeuery(contact, key, contactChan, valueChan)
-			}()
-		}
-		select {
-		case <-time.After(TIME_INTERVAL):
-			break
-		case <-stop:
-			// fmt.Println("Stop here Print")
-			break HandleLoop
-		}
+func (k *Kademlia) DoFindNode(contact *Contact, searchKey ID) string {
+	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
+	nodes, err := k.FindNode(context.Background(), contact, searchKey)
+	if err != nil {
+		return err.Error()
 	}
-	//wait till zero
-	//fmt.Println("Dead here 4")
 
-	var stopType int
-	stopper.stopMutex.RLock()
-	stopType = stopper.value
-	stopper.stopMutex.RUnlock()
-	//fmt.Println("Dead here 5")
+	res := k.ContactsToString(nodes)
+	if res == "" {
+		return "No Record"
+	}
+	return "ok, result is: " + res
+}
 
-	for {
-		//fmt.Println("Waiting for zero")
-		if stopType != 3 && len(valueChan) != 0 {
-			updatedValuer := <-valueChan
-			//returnValue = updatedValuer.value
-			returnValuer.returnedValuerMutex.Lock()
-			returnValuer.value = updatedValuer.value
-			returnValuer.returnedValueMap[updatedValuer.NodeID] = true
-			returnValuer.returnedValuerMutex.Unlock()
-			stopper.stopMutex.Lock()
-			stopper.value = 3
-			stopType = 3
-			stopper.stopMutex.Unlock()
-			//fmt.Println("OK ValueChan")
-			break
-		} else {
-			break
-		}
+func (k *Kademlia) DoFindValue(contact *Contact, searchKey ID) string {
+	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
+	value, nodes, err := k.FindValue(context.Background(), contact, searchKey)
+	if err != nil {
+		return err.Error()
 	}
 
-	var returnString string
-	// var returnContacts []Contact
-	//fmt.Println("~~~~~~~~~~~~~~~~~Why stop" + strconv.Itoa(stopType))
-
-	if stopType == 3 {
-		//fmt.Println("Find Value stop 3!!!!!!!!!!!!!!!!!!!!!!!!!!!!")
-		fmt.Println(strconv.Itoa(len(returnValuer.returnedValueMap)))
-		returnValue = returnValuer.value
-		// shortListLen := len(shortList)
-		// for i := 0; i < shortListLen; i++ {
-		// 	contactItem := <-shortList
-		// 	returnContacts = append(returnContacts, contactItem)
-		// }
-		// for _, contactItem := range returnContacts {
-		// 	if _, ok := returnedValueMap[contactItem.NodeID]; ok == false {
-		// 		k.DoStore(&contactItem, key, returnValue)
-		// 	}
-		// }
-		// // returnString = "Value: " + string(returnValue[:])
-		// for k := range returnedValueMap {
-		// 	returnString = returnString + "Value: " + string(returnValue[:]) + " ID: " + k.AsString() + ", "
-		// }
-		// returnString = returnString[:len(returnString)-2]
-		clostestNode.shortDistanceMutex.RLock()
-		dostoreContact := clostestNode.selfContact
-		clostestNode.shortDistanceMutex.RUnlock()
-		k.DoStore(&dostoreContact, key, returnValue)
-		for k := range returnValuer.returnedValueMap {
-			//fmt.Println("Here in Find value: " + string(returnValue[:]))
-			returnString = returnString + " ID: " + k.AsString() + " Value: " + string(returnValue[:])
-			break
-		}
-		//returnString = returnString[:len(returnString)-2]
+	var res string
+	//if value if found return value, else return closest contacts
+	if value != nil {
+		res = res + string(value[:])
 	} else {
-		returnString = "ERR: Value not found"
+		res = res + k.ContactsToString(nodes)
+	}
+	if res == "" {
+		return "No Record"
 	}
-	return returnString
+	return "ok, result is: " + res
 }
 
-func (k *Kademlia) iterFindValuQeuery(contact Contact, searchKey ID, contactChan chan Contacter, valuerChan chan Valuer) error {
-	client, err := rpc.DialHTTPPath("tcp", contact.Host.String()+":"+strconv.Itoa(int(contact.Port)), rpc.DefaultRPCPath+strconv.Itoa(int(contact.Port)))
+func (k *Kademlia) LocalFindValue(searchKey ID) string {
+	// If all goes well, return "OK: <output>", otherwise print "ERR: <messsage>"
+	value, err := k.LocalValue(searchKey)
 	if err != nil {
-		return err
+		return "ERR: Not implemented"
 	}
+	return "OK:" + string(value[:])
+}
 
-	//create find value request and result
-	findValueReq := new(FindValueRequest)
-	findValueReq.Sender = k.SelfContact
-	findValueReq.MsgID = NewRandomID()
-	findValueReq.Key = searchKey
-
-	findValueRes := new(FindValueResult)
+func (k *Kademlia) DoIterativeFindNode(id ID) string {
 
-	//find value
-	err = client.Call("KademliaCore.FindValue", findValueReq, findValueRes)
-	// fmt.Println("Get RPC call back")
-	if err != nil {
-		return err
+	ctx, cancel := lookupContext()
+	defer cancel()
+	shortlist, _ := k.IterativeFindNode(ctx, id)
+	// shortcontacts := FindClosestContactsBySort(shortlist)
+	return k.ContactsToString(shortlist)
+}
 
+func (k *Kademlia) DoIterativeStore(key ID, value []byte) string {
+	// For project 2!
+	ctx, cancel := lookupContext()
+	defer cancel()
+	contactList, _ := k.IterativeStore(ctx, key, value, 0)
+	var result string
+	for _, contact := range contactList {
+		result = result + "NodeId" + contact.NodeID.AsString()
 	}
+	return result
+}
 
-	defer client.Close()
-
-	//update contact
-	k.UpdateContact(contact)
-	if findValueRes.Nodes != nil {
-		for _, contactItem := range findValueRes.Nodes {
-			k.UpdateContact(contactItem)
-		}
-	}
-	if findValueRes.Value != nil {
-		valuer := new(Valuer)
-		valuer.value = findValueRes.Value
-		valuer.NodeID = contact.NodeID
-		// fmt.Println("Put things in valueChan")
-		valuerChan <- *valuer
-	} else if findValueRes.Nodes != nil {
-		contacter := new(Contacter)
-		contacter.contactList = findValueRes.Nodes
-		contacter.selfContact = contact
-		// fmt.Println("Put things in contactChan")
-		contactChan <- *contacter
+func (k *Kademlia) DoIterativeFindValue(key ID) string {
+	ctx, cancel := lookupContext()
+	defer cancel()
+	value, contacts, err := k.IterativeFindValue(ctx, key)
+	if err != nil {
+		return "ERR: Value not found"
 	}
-	return err
+	return " ID: " + contacts[0].NodeID.AsString() + " Value: " + string(value[:])
 }
 
 ///////////////////////////////////////////////////////////////////////////////
 // methods for bucket
 ///////////////////////////////////////////////////////////////////////////////
 
+// Move a contact we heard from to the back of its bucket. When the bucket is
+// full the contact waits in the bucket's replacement cache while its least
+// recently seen contact is pinged in the background; that one is replaced if
+// it does not answer.
 func (k *Kademlia) UpdateContact(contact Contact) {
-	//Find bucket
-	// fmt.Println("Begin update")
-
-	// fmt.Println("*********" + contact.Host.String())
-	bucket := k.FindBucket(contact.NodeID)
-	if bucket == nil {
-		return
+	if lru, check := k.table.Update(contact); check {
+		go k.checkLRU(lru)
 	}
-	//Find contact, check if conact exist
-	res, err := k.FindContactInBucket(contact.NodeID, bucket)
-
-	//if contact has already existed, then move contact to the end of bucket
-	if err == nil {
-		k.storeMutex.Lock()
-		bucket.MoveToBack(res)
-		k.storeMutex.Unlock()
-		//if contact is not found
-	} else {
-		//check if bucket is full, if not, add contact to the end of bucket
-		k.storeMutex.RLock()
-		bucketLength := bucket.Len()
-		k.storeMutex.RUnlock()
-		if bucketLength < MAX_BUCKET_SIZE {
-			k.storeMutex.Lock()
-			bucket.PushBack(contact)
-			k.storeMutex.Unlock()
-
-			//if bucket id full, ping the least recently contact node.
-		} else {
-			k.storeMutex.Lock()
-			front := bucket.Front()
-			k.storeMutex.Unlock()
-			lrc_node := front.Value.(Contact)
-			pingresult := k.DoPing(lrc_node.Host, lrc_node.Port)
-
-			/*if least recent contact respond, ignore the new contact and move the least recent contact to
-			  the end of the bucket
-			*/
-			if pingresult == "ok" {
-				k.storeMutex.Lock()
-				bucket.MoveToBack(front)
-				k.storeMutex.Unlock()
-
-				// if it does not respond, delete it and add the new contact to the end of the bucket
-			} else {
-				k.storeMutex.Lock()
-				bucket.Remove(front)
-				bucket.PushBack(contact)
-				k.storeMutex.Unlock()
-
-			}
-
-		}
-
-	}
-	// fmt.Println("Update contact succeed, nodeid is : " + contact.NodeID.AsString())
+}
 
+// Stop serving RPCs, close the connections to and from other nodes and close
+// the stores. The node can't be used afterwards.
+func (k *Kademlia) Close() error {
+	k.closeOnce.Do(func() { close(k.done) })
+	k.pool.close()
+	err := k.listener.Close()
+	return errors.Join(err, k.values.Close(), k.published.Close(), k.vdos.Close())
 }
 
-func (k *Kademlia) FindBucket(nodeid ID) *list.List {
-	k.storeMutex.RLock()
-	defer k.storeMutex.RUnlock()
-	prefixLength := k.NodeID.Xor(nodeid).PrefixLen()
-	if prefixLength == 160 {
-		return nil
+//how long a value stored for ttl is kept under this node's policy
+func (k *Kademlia) valueTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		ttl = k.config.DefaultValueTTL
 	}
-	bucketIndex := (IDBytes * 8) - prefixLength
-
-	//if ping yourself, then the distance would be 160, and it will ran out of index
-	if bucketIndex > (IDBytes*8 - 1) {
-		bucketIndex = (IDBytes*8 - 1)
+	if ttl > k.config.MaxValueTTL {
+		ttl = k.config.MaxValueTTL
 	}
-
-	bucket := k.buckets[bucketIndex]
-	return bucket
+	return ttl
 }
 
-func (k *Kademlia) FindContactInBucket(nodeId ID, bucket *list.List) (*list.Element, error) {
-	k.storeMutex.RLock()
-	defer k.storeMutex.RUnlock()
-	for i := bucket.Front(); i != nil; i = i.Next() {
-		c := i.Value.(Contact)
-		if c.NodeID.Equals(nodeId) {
-			return i, nil
-		}
-	}
-	return nil, &NotFoundError{nodeId, "Not found"}
+func (k *Kademlia) storeValue(key ID, value []byte, ttl time.Duration) error {
+	return k.storeValueFrom(nil, key, value, ttl)
 }
 
-func (k *Kademlia) FindClosestContacts(searchKey ID, senderKey ID) []Contact {
-	contactDistanceList := k.FindAllKnownContact(searchKey, senderKey)
-	result := k.FindClosestContactsBySort(contactDistanceList)
-	return result
-
+//the value stored under key and how long it has left, expired values are
+//never returned even before the sweeper deletes them
+func (k *Kademlia) localValue(key ID) ([]byte, time.Duration, bool) {
+	stored, ok, err := k.values.Get(key)
+	ttl := stored.Expires.Sub(k.config.Clock.Now())
+	if err != nil || !ok || ttl <= 0 {
+		return nil, 0, false
+	}
+	return stored.Value, ttl, true
 }
 
-func (k *Kademlia) FindAllKnownContact(searchKey ID, senderKey ID) []ContactDistance {
-	k.storeMutex.RLock()
-	defer k.storeMutex.RUnlock()
-	result := make([]ContactDistance, 0)
-	bucketIndex := 0
-	for bucketIndex < IDBytes*8 {
-		targetBucket := k.buckets[bucketIndex]
-		for i := targetBucket.Front(); i != nil; i = i.Next() {
-			if !i.Value.(Contact).NodeID.Equals(senderKey) {
-				contactD := new(ContactDistance)
-				contactD.SelfContact = i.Value.(Contact)
-				contactD.Distance = i.Value.(Contact).NodeID.Xor(searchKey)
-				result = append(result, *contactD)
-			}
+//run f every interval until the node is closed
+func (k *Kademlia) every(interval time.Duration, f func()) {
+	for {
+		select {
+		case <-k.config.Clock.After(interval):
+		case <-k.done:
+			return
 		}
-		bucketIndex++
+		f()
 	}
+}
 
-	if len(result) == 0 {
-		return nil
-	}
+//delete expired values, and the published ones whose lifetime is over so
+//they don't wait for the next republish
+func (k *Kademlia) sweepValues() {
+	now := k.config.Clock.Now()
+	k.values.Iterate(func(key ID, stored StoreEntry) bool {
+		if !now.Before(stored.Expires) {
+			k.deleteExpiredValue(key, now)
+		}
+		return true
+	})
+	k.published.Iterate(func(key ID, published StoreEntry) bool {
+		if !now.Before(published.Expires) {
+			k.published.Delete(key)
+		}
+		return true
+	})
+}
 
-	return result
+//index of the bucket nodeid belongs in, -1 for our own ID
+func (k *Kademlia) bucketIndex(nodeid ID) int {
+	return k.table.bucketIndex(nodeid)
+}
 
+func (k *Kademlia) FindClosestContacts(searchKey ID, senderKey ID) []Contact {
+	return k.table.Closest(searchKey, senderKey, MAX_BUCKET_SIZE)
 }
 
 func (k *Kademlia) FindClosestContactsBySort(contactDistanceList []ContactDistance) []Contact {
@@ -1117,26 +709,9 @@ func (k *Kademlia) ContactDistanceToString(contacts []ContactDistance) string {
 }
 
 func (k *Kademlia) PingWithOutUpdate(host net.IP, port uint16) string {
-
-	var ping PingMessage
-	ping.MsgID = NewRandomID()
-	ping.Sender = k.SelfContact
-
-	// fmt.Println("***IN DO ping: " + k.SelfContact.Host.String())
-
-	var pong PongMessage
-	// client, err := rpc.DialHTTP("tcp", string(host) + ":" + string(port))
-	client, err := rpc.DialHTTP("tcp", host.String()+":"+strconv.Itoa(int(port)))
-	if err != nil {
-		log.Fatal("DialHTTP: ", err)
-	}
-	err = client.Call("KademliaCore.Ping", ping, &pong)
-
-	if err != nil {
+	if _, err := k.ping(context.Background(), host, port); err != nil {
 		return "ERR: " + err.Error()
 	}
-
-	defer client.Close()
 	return "ok"
 }
 
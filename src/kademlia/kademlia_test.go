@@ -1,10 +1,22 @@
 package kademlia
 
 import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"errors"
 	"math/rand"
 	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 	// "encoding/json"
 	//"strings"
 	// "io"
@@ -43,10 +55,12 @@ func StringToIpPort(laddr string) (ip net.IP, port uint16, err error) {
 }
 
 func TestPing(t *testing.T) {
-	instance1 := NewKademlia(CreateIdForTest(string(1)), "localhost:7890")
-	instance2 := NewKademlia(CreateIdForTest(string(2)), "localhost:7891")
-	host2, port2, _ := StringToIpPort("localhost:7891")
+	instance1 := NewKademlia(CreateIdForTest(string(rune(1))), "localhost:0")
+	instance2 := NewKademlia(CreateIdForTest(string(rune(2))), "localhost:0")
+	defer closeNetwork([]*Kademlia{instance1, instance2})
+	host2, port2 := instance2.SelfContact.Host, instance2.SelfContact.Port
 	instance1.DoPing(host2, port2)
+	confirmed(instance2)
 	contact2, err := instance1.FindContact(instance2.NodeID)
 	if err != nil {
 		t.Error("Instance 2's contact not found in Instance 1's contact list")
@@ -67,11 +81,13 @@ func TestPing(t *testing.T) {
 }
 
 func TestFindNode(t *testing.T) {
-	instance1 := NewKademlia(CreateIdForTest(string(1)), "localhost:7892")
-	instance2 := NewKademlia(CreateIdForTest(string(2)), "localhost:7893")
-	instance3 := NewKademlia(CreateIdForTest(string(3)), "localhost:7894")
-	host2, port2, _ := StringToIpPort("localhost:7893")
+	instance1 := NewKademlia(CreateIdForTest(string(rune(1))), "localhost:0")
+	instance2 := NewKademlia(CreateIdForTest(string(rune(2))), "localhost:0")
+	instance3 := NewKademlia(CreateIdForTest(string(rune(3))), "localhost:0")
+	defer closeNetwork([]*Kademlia{instance1, instance2, instance3})
+	host2, port2 := instance2.SelfContact.Host, instance2.SelfContact.Port
 	instance1.DoPing(host2, port2)
+	confirmed(instance2)
 	contact2, err := instance1.FindContact(instance2.NodeID)
 	if err != nil {
 		t.Error("Instance 2's contact not found in Instance 1's contact list")
@@ -89,6 +105,7 @@ func TestFindNode(t *testing.T) {
 		t.Error("Instance 2 ID incorrectly stored in Instance 1's contact list")
 	}
 	instance3.DoPing(host2, port2)
+	confirmed(instance2)
 	instance1ID := instance1.SelfContact.NodeID
 	instance2ID := instance2.SelfContact.NodeID
 	instance3ID := instance3.SelfContact.NodeID
@@ -108,10 +125,12 @@ func TestFindNode(t *testing.T) {
 }
 
 func TestStore(t *testing.T) {
-	instance1 := NewKademlia(CreateIdForTest(string(1)), "localhost:7895")
-	instance2 := NewKademlia(CreateIdForTest(string(2)), "localhost:7896")
-	host2, port2, _ := StringToIpPort("localhost:7896")
+	instance1 := NewKademlia(CreateIdForTest(string(rune(1))), "localhost:0")
+	instance2 := NewKademlia(CreateIdForTest(string(rune(2))), "localhost:0")
+	defer closeNetwork([]*Kademlia{instance1, instance2})
+	host2, port2 := instance2.SelfContact.Host, instance2.SelfContact.Port
 	instance1.DoPing(host2, port2)
+	confirmed(instance2)
 	contact2, err := instance1.FindContact(instance2.NodeID)
 	if err != nil {
 		t.Error("Instance 2's contact not found in Instance 1's contact list")
@@ -146,11 +165,13 @@ func TestStore(t *testing.T) {
 }
 
 func TestFindValue(t *testing.T) {
-	instance1 := NewKademlia(CreateIdForTest(string(1)), "localhost:7897")
-	instance2 := NewKademlia(CreateIdForTest(string(2)), "localhost:7898")
-	instance3 := NewKademlia(CreateIdForTest(string(3)), "localhost:7899")
-	host2, port2, _ := StringToIpPort("localhost:7898")
+	instance1 := NewKademlia(CreateIdForTest(string(rune(1))), "localhost:0")
+	instance2 := NewKademlia(CreateIdForTest(string(rune(2))), "localhost:0")
+	instance3 := NewKademlia(CreateIdForTest(string(rune(3))), "localhost:0")
+	defer closeNetwork([]*Kademlia{instance1, instance2, instance3})
+	host2, port2 := instance2.SelfContact.Host, instance2.SelfContact.Port
 	instance1.DoPing(host2, port2)
+	confirmed(instance2)
 	contact2, err := instance1.FindContact(instance2.NodeID)
 	if err != nil {
 		t.Error("Instance 2's contact not found in Instance 1's contact list")
@@ -168,6 +189,7 @@ func TestFindValue(t *testing.T) {
 		t.Error("Instance 2 ID incorrectly stored in Instance 1's contact list")
 	}
 	instance3.DoPing(host2, port2)
+	confirmed(instance2)
 	instance1ID := instance1.SelfContact.NodeID
 	instance2ID := instance2.SelfContact.NodeID
 	instance3ID := instance3.SelfContact.NodeID
@@ -191,14 +213,1326 @@ func TestFindValue(t *testing.T) {
 	return
 }
 
+func TestTypedAPI(t *testing.T) {
+	instance1 := NewKademlia(CreateIdForTest(string(rune(1))), "localhost:0")
+	instance2 := NewKademlia(CreateIdForTest(string(rune(2))), "localhost:0")
+	defer closeNetwork([]*Kademlia{instance1, instance2})
+	contact2, err := instance1.Ping(context.Background(), instance2.SelfContact.Host, instance2.SelfContact.Port)
+	if err != nil || !contact2.NodeID.Equals(instance2.NodeID) {
+		t.Fatal("ERR: Ping did not return instance 2's contact")
+	}
+
+	key := NewRandomID()
+	if err := instance1.Store(context.Background(), &contact2, key, []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	value, err := instance2.LocalValue(key)
+	if err != nil || string(value) != "value" {
+		t.Error("ERR: value not stored on instance 2")
+	}
+	value, nodes, err := instance1.FindValue(context.Background(), &contact2, key)
+	if err != nil || string(value) != "value" || nodes != nil {
+		t.Error("ERR: FindValue did not return the stored value")
+	}
+	if _, err := instance1.LocalValue(key); !errors.Is(err, ErrNotFound) {
+		t.Error("ERR: LocalValue did not return ErrNotFound")
+	}
+	if _, err := instance1.FindContact(NewRandomID()); !errors.Is(err, ErrNotFound) {
+		t.Error("ERR: FindContact did not return ErrNotFound")
+	}
+
+	host, port := deadAddress(t)
+	if _, err := instance1.Ping(context.Background(), host, port); !errors.Is(err, ErrUnreachable) {
+		t.Error("ERR: Ping to a dead peer did not return ErrUnreachable")
+	}
+}
+
+func TestContextDeadlines(t *testing.T) {
+	instance1 := NewKademlia(CreateIdForTest(string(rune(1))), "localhost:0")
+	defer instance1.Close()
+
+	//accepts connections but never answers
+	blackhole, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackhole.Close()
+	go func() {
+		for {
+			conn, err := blackhole.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	addr := blackhole.Addr().(*net.TCPAddr)
+	host, port := addr.IP, uint16(addr.Port)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := instance1.Ping(ctx, host, port); !errors.Is(err, ErrTimeout) {
+		t.Error("ERR: Ping to a blackholed peer did not return ErrTimeout:", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("ERR: Ping ignored its deadline")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := instance1.IterativeFindNode(ctx, NewRandomID()); !errors.Is(err, context.Canceled) {
+		t.Error("ERR: IterativeFindNode with a cancelled context did not return context.Canceled:", err)
+	}
+	if _, _, err := instance1.IterativeFindValue(ctx, NewRandomID()); !errors.Is(err, context.Canceled) {
+		t.Error("ERR: IterativeFindValue with a cancelled context did not return context.Canceled:", err)
+	}
+}
+
+func TestClientPool(t *testing.T) {
+	instance1 := NewKademlia(CreateIdForTest(string(rune(1))), "localhost:0")
+	instance2 := NewKademlia(CreateIdForTest(string(rune(2))), "localhost:0")
+	defer closeNetwork([]*Kademlia{instance1, instance2})
+	address := instance2.SelfContact.Host.String() + ":" + strconv.Itoa(int(instance2.SelfContact.Port))
+	idle := func() int {
+		instance1.pool.mutex.Lock()
+		defer instance1.pool.mutex.Unlock()
+		return len(instance1.pool.peers[address].idle)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := instance1.Ping(context.Background(), instance2.SelfContact.Host, instance2.SelfContact.Port); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if idle() != 1 {
+		t.Error("ERR: sequential pings did not reuse one connection, idle:", idle())
+	}
+
+	done := make(chan error)
+	for i := 0; i < 20; i++ {
+		go func() {
+			_, err := instance1.Ping(context.Background(), instance2.SelfContact.Host, instance2.SelfContact.Port)
+			done <- err
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if idle() > MAX_PEER_CONNECTIONS {
+		t.Error("ERR: more than MAX_PEER_CONNECTIONS connections to one peer, idle:", idle())
+	}
+
+	if !healthy(rpc.ServerError("no such value")) || healthy(rpc.ErrShutdown) {
+		t.Error("ERR: healthy misclassified an RPC error")
+	}
+}
+
+func TestEvictUnresponsiveContact(t *testing.T) {
+	instance := NewKademlia(CreateIdForTest(string(rune(1))), "localhost:0")
+	defer instance.Close()
+	//all differ from instance in the first bit, so they share one bucket
+	farID := func(i int) ID {
+		return CreateIdForTest(string([]byte{0x80, byte(i)}))
+	}
+	peers := make([]*Kademlia, MAX_BUCKET_SIZE)
+	for i := range peers {
+		peers[i] = NewKademlia(farID(i), "localhost:0")
+		peers[i].DoPing(instance.SelfContact.Host, instance.SelfContact.Port)
+		confirmed(instance)
+	}
+	defer closeNetwork(peers)
+
+	bucketIndex := instance.bucketIndex(farID(0))
+	checked := func() bool {
+		instance.table.mutex.RLock()
+		defer instance.table.mutex.RUnlock()
+		return !instance.table.checkingLRU[bucketIndex]
+	}
+
+	//the least recently seen contact answers, so it stays
+	newcomer1 := NewKademlia(farID(100), "localhost:0")
+	defer newcomer1.Close()
+	newcomer1.DoPing(instance.SelfContact.Host, instance.SelfContact.Port)
+	confirmed(instance)
+	if !eventually(5*time.Second, checked) {
+		t.Fatal("ERR: least recently seen contact was not checked")
+	}
+	if _, err := instance.FindContact(newcomer1.NodeID); err == nil {
+		t.Error("ERR: full bucket took a new contact while its oldest one was alive")
+	}
+	if _, err := instance.FindContact(peers[0].NodeID); err != nil {
+		t.Error("ERR: live contact was evicted")
+	}
+
+	//peers[0] was moved to the back, peers[1] is now the oldest
+	peers[1].Close()
+	newcomer2 := NewKademlia(farID(101), "localhost:0")
+	defer newcomer2.Close()
+	if res := newcomer2.DoPing(instance.SelfContact.Host, instance.SelfContact.Port); res != "ok" {
+		t.Fatal("ERR: ping during eviction failed:", res)
+	}
+	confirmed(instance)
+	if !eventually(5*time.Second, checked) {
+		t.Fatal("ERR: least recently seen contact was not checked")
+	}
+	if _, err := instance.FindContact(peers[1].NodeID); err == nil {
+		t.Error("ERR: unresponsive contact was not evicted")
+	}
+	if _, err := instance.FindContact(newcomer2.NodeID); err != nil {
+		t.Error("ERR: unresponsive contact was not replaced by the most recent candidate")
+	}
+	if res := instance.PingWithOutUpdate(peers[1].SelfContact.Host, peers[1].SelfContact.Port); res == "ok" {
+		t.Error("ERR: PingWithOutUpdate reached a closed node")
+	}
+	if res := instance.DoPing(peers[2].SelfContact.Host, peers[2].SelfContact.Port); res != "ok" {
+		t.Error("ERR: node stopped working after evicting a dead peer:", res)
+	}
+
+	//a contact failing repeated RPCs is replaced by the remaining candidate
+	peers[2].Close()
+	for i := 0; i < MAX_CONTACT_FAILURES; i++ {
+		if _, err := instance.FindNode(context.Background(), &peers[2].SelfContact, NewRandomID()); err == nil {
+			t.Fatal("ERR: FindNode reached a closed node")
+		}
+		if _, err := instance.FindContact(peers[2].NodeID); (err == nil) != (i < MAX_CONTACT_FAILURES-1) {
+			t.Fatal("ERR: contact replaced after", i+1, "failures")
+		}
+	}
+	if _, err := instance.FindContact(newcomer1.NodeID); err != nil {
+		t.Error("ERR: failing contact was not replaced by the cached candidate")
+	}
+}
+
+func TestRoutingTableConcurrency(t *testing.T) {
+	instance := NewKademlia(NewRandomID(), "localhost:0")
+	defer instance.Close()
+	clients := make([]*Kademlia, 4)
+	for i := range clients {
+		clients[i] = NewKademlia(NewRandomID(), "localhost:0")
+		defer clients[i].Close()
+	}
+	self := instance.SelfContact
+	//nothing listens there, so LRU checks of these contacts fail
+	deadHost, deadPort := deadAddress(t)
+
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *Kademlia) {
+			defer wg.Done()
+			ctx := context.Background()
+			for i := 0; i < 50; i++ {
+				key := NewRandomID()
+				client.Ping(ctx, self.Host, self.Port)
+				client.Store(ctx, &self, key, []byte("value"), 0)
+				client.FindNode(ctx, &self, key)
+				client.FindValue(ctx, &self, key)
+			}
+		}(client)
+	}
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				contact := Contact{NewRandomID(), deadHost, deadPort}
+				instance.UpdateContact(contact)
+				instance.table.Closest(contact.NodeID, instance.NodeID, MAX_BUCKET_SIZE)
+				if i%3 == 0 {
+					instance.table.Remove(contact.NodeID)
+				}
+				if i%5 == 0 {
+					instance.table.Failed(contact)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	rt := instance.table
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	for i, bucket := range rt.buckets {
+		if bucket.Len() > MAX_BUCKET_SIZE {
+			t.Error("ERR: bucket", i, "holds", bucket.Len(), "contacts")
+		}
+		seen := make(map[ID]bool)
+		for e := bucket.Front(); e != nil; e = e.Next() {
+			id := e.Value.(Contact).NodeID
+			if seen[id] {
+				t.Error("ERR: contact twice in bucket", i)
+			}
+			seen[id] = true
+			if rt.bucketIndex(id) != i {
+				t.Error("ERR: contact in the wrong bucket", i)
+			}
+			if findInList(rt.replacements[i], id) != nil {
+				t.Error("ERR: contact both in bucket", i, "and its replacement cache")
+			}
+		}
+	}
+	//clients may wait in a replacement cache while their bucket is full
+	for _, client := range clients {
+		bucketIndex := rt.bucketIndex(client.NodeID)
+		if findInList(rt.buckets[bucketIndex], client.NodeID) == nil && findInList(rt.replacements[bucketIndex], client.NodeID) == nil {
+			t.Error("ERR: client missing from the routing table")
+		}
+	}
+}
+
+// A Clock that only moves when told to.
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	timer := fakeTimer{c.now.Add(d), make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	return timer.c
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+func TestValueExpiration(t *testing.T) {
+	clock := newFakeClock()
+	config := DefaultConfig()
+	config.Clock = clock
+	config.DefaultValueTTL = 10 * time.Minute
+	config.MaxValueTTL = time.Hour
+	instance1 := NewKademlia(CreateIdForTest(string(rune(1))), "localhost:0")
+	instance2 := NewKademliaWithConfig(CreateIdForTest(string(rune(2))), "localhost:0", config)
+	defer instance1.Close()
+	defer instance2.Close()
+	contact2 := instance2.SelfContact
+
+	capped, defaulted := NewRandomID(), NewRandomID()
+	if err := instance1.Store(context.Background(), &contact2, capped, []byte("capped"), 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := instance1.Store(context.Background(), &contact2, defaulted, []byte("defaulted"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(9 * time.Minute)
+	if _, err := instance2.LocalValue(defaulted); err != nil {
+		t.Error("ERR: value expired before the default TTL")
+	}
+	clock.Advance(2 * time.Minute)
+	if _, err := instance2.LocalValue(defaulted); !errors.Is(err, ErrNotFound) {
+		t.Error("ERR: value outlived the default TTL")
+	}
+
+	clock.Advance(48 * time.Minute)
+	value, _, err := instance1.FindValue(context.Background(), &contact2, capped)
+	if err != nil || string(value) != "capped" {
+		t.Error("ERR: value expired before the node's maximum TTL")
+	}
+	clock.Advance(2 * time.Minute)
+	value, _, err = instance1.FindValue(context.Background(), &contact2, capped)
+	if err != nil || value != nil {
+		t.Error("ERR: FindValue returned a value past the node's maximum TTL")
+	}
+
+	//the sweeper deletes both once it runs
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		clock.Advance(config.SweepInterval)
+		if storeLen(instance2.values) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ERR: sweeper did not delete expired values")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Start nodes on free ports that all know each other.
+func startNetwork(config Config, ids []ID) []*Kademlia {
+	nodes := make([]*Kademlia, len(ids))
+	for i := range ids {
+		nodes[i] = NewKademliaWithConfig(ids[i], "localhost:0", config)
+	}
+	for i := range nodes {
+		for j := range nodes {
+			if i != j {
+				nodes[i].DoPing(nodes[j].SelfContact.Host, nodes[j].SelfContact.Port)
+			}
+		}
+	}
+	return nodes
+}
+
+func closeNetwork(nodes []*Kademlia) {
+	for _, node := range nodes {
+		node.Close()
+	}
+}
+
+// An address nothing listens on.
+func deadAddress(t *testing.T) (net.IP, uint16) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	l.Close()
+	return addr.IP, uint16(addr.Port)
+}
+
+// Wait up to timeout for cond to hold.
+func eventually(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+//wait for the contacts k is confirming to be added or dropped
+func confirmed(k *Kademlia) {
+	eventually(2*RPC_TIMEOUT, func() bool {
+		k.confirming.mutex.Lock()
+		defer k.confirming.mutex.Unlock()
+		return len(k.confirming.pending) == 0
+	})
+}
+
+func storedExpiry(k *Kademlia, key ID) (time.Time, bool) {
+	stored, ok, _ := k.values.Get(key)
+	return stored.Expires, ok
+}
+
+func storeLen(s Store) int {
+	n := 0
+	s.Iterate(func(ID, StoreEntry) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func TestReplicateValues(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	config := DefaultConfig()
+	config.Clock = clock
+	config.RepublishInterval = 1000 * time.Hour
+	ids := []ID{NewRandomID(), NewRandomID(), NewRandomID(), NewRandomID()}
+	nodes := startNetwork(config, ids)
+	defer closeNetwork(nodes)
+
+	//only nodes[0] holds the value, nodes[3] is the closest node to its key
+	key := ids[3]
+	contact0 := nodes[0].SelfContact
+	if err := nodes[1].Store(context.Background(), &contact0, key, []byte("value"), 4*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(config.ReplicateInterval)
+	if !eventually(20*time.Second, func() bool {
+		_, ok := storedExpiry(nodes[3], key)
+		return ok
+	}) {
+		t.Fatal("ERR: value was not replicated to the closest node")
+	}
+	//replicas expire with the original
+	if expires, _ := storedExpiry(nodes[3], key); !expires.Equal(start.Add(4 * time.Hour)) {
+		t.Error("ERR: replication changed the value's expiry to", expires)
+	}
+}
+
+func TestRepublishValues(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	config := DefaultConfig()
+	config.Clock = clock
+	config.MaxValueTTL = time.Hour
+	config.RepublishInterval = 50 * time.Minute
+	config.ReplicateInterval = 1000 * time.Hour
+	ids := []ID{NewRandomID(), NewRandomID(), NewRandomID(), NewRandomID()}
+	nodes := startNetwork(config, ids)
+	defer closeNetwork(nodes)
+
+	key := NewRandomID()
+	ctx, cancel := context.WithTimeout(context.Background(), LOOKUP_TIMEOUT)
+	defer cancel()
+	stored, err := nodes[0].IterativeStore(ctx, key, []byte("value"), 3*time.Hour)
+	if len(stored) == 0 {
+		t.Fatal("ERR: value was not stored:", err)
+	}
+	var holder *Kademlia
+	for _, node := range nodes {
+		if node.NodeID.Equals(stored[0].NodeID) {
+			holder = node
+		}
+	}
+
+	//the holder caps the TTL, republishing keeps the value alive
+	if expires, _ := storedExpiry(holder, key); !expires.Equal(start.Add(time.Hour)) {
+		t.Fatal("ERR: value not stored with the node's maximum TTL")
+	}
+	clock.Advance(config.RepublishInterval)
+	if !eventually(20*time.Second, func() bool {
+		expires, _ := storedExpiry(holder, key)
+		return expires.Equal(start.Add(config.RepublishInterval + time.Hour))
+	}) {
+		t.Fatal("ERR: value was not republished")
+	}
+
+	//once its lifetime is over the publisher stops and the value is gone
+	clock.Advance(3*time.Hour + time.Minute - config.RepublishInterval)
+	if !eventually(5*time.Second, func() bool {
+		return storeLen(nodes[0].published) == 0
+	}) {
+		t.Fatal("ERR: publisher kept a value past its lifetime")
+	}
+	if _, err := holder.LocalValue(key); !errors.Is(err, ErrNotFound) {
+		t.Error("ERR: value outlived its publisher's republishing")
+	}
+}
+
+func TestRefreshBuckets(t *testing.T) {
+	clock := newFakeClock()
+	config := DefaultConfig()
+	config.Clock = clock
+	ids := []ID{NewRandomID(), NewRandomID(), NewRandomID(), NewRandomID(), NewRandomID()}
+	nodes := startNetwork(config, ids[1:])
+	defer closeNetwork(nodes)
+
+	quiet := NewKademliaWithConfig(ids[0], "localhost:0", config)
+	defer quiet.Close()
+	for i := 1; i < IDBytes*8; i++ {
+		if index := quiet.bucketIndex(quiet.randomIDInBucket(i)); index != i {
+			t.Fatal("ERR: random ID for bucket", i, "belongs in bucket", index)
+		}
+	}
+
+	//the quiet node only knows nodes[0] until its buckets are refreshed
+	quiet.DoPing(nodes[0].SelfContact.Host, nodes[0].SelfContact.Port)
+	clock.Advance(config.RefreshInterval)
+	if !eventually(20*time.Second, func() bool {
+		for _, node := range nodes {
+			if _, err := quiet.FindContact(node.NodeID); err != nil {
+				return false
+			}
+		}
+		return true
+	}) {
+		t.Fatal("ERR: refresh did not find the other nodes")
+	}
+	bucketIndex := quiet.bucketIndex(nodes[0].NodeID)
+	for _, stale := range quiet.staleBuckets() {
+		if stale == bucketIndex {
+			t.Error("ERR: refreshed bucket is still stale")
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	ids := make([]ID, 6)
+	for i := range ids {
+		ids[i] = NewRandomID()
+	}
+	nodes := startNetwork(DefaultConfig(), ids)
+	defer closeNetwork(nodes)
+
+	joiner := NewKademlia(NewRandomID(), "localhost:0")
+	defer joiner.Close()
+	deadHost, deadPort := deadAddress(t)
+	dead := net.JoinHostPort(deadHost.String(), strconv.Itoa(int(deadPort)))
+	seed := net.JoinHostPort(nodes[0].SelfContact.Host.String(), strconv.Itoa(int(nodes[0].SelfContact.Port)))
+	if err := joiner.Join(context.Background(), []string{dead}); !errors.Is(err, ErrUnreachable) {
+		t.Error("ERR: Join through a dead seed did not return ErrUnreachable:", err)
+	}
+	if err := joiner.Join(context.Background(), []string{dead, seed}); err != nil {
+		t.Fatal("ERR: Join failed with one live seed:", err)
+	}
+	for _, node := range nodes {
+		if _, err := joiner.FindContact(node.NodeID); err != nil {
+			t.Error("ERR: joined node does not know", node.NodeID.AsString())
+		}
+	}
+	if _, err := nodes[0].FindContact(joiner.NodeID); err != nil {
+		t.Error("ERR: seed does not know the joined node")
+	}
+}
+
+func TestLookupSortedClosest(t *testing.T) {
+	//a ring where each node only knows the next three, so lookups need hops
+	nodes := make([]*Kademlia, 30)
+	for i := range nodes {
+		nodes[i] = NewKademlia(NewRandomID(), "localhost:0")
+	}
+	defer closeNetwork(nodes)
+	for i := range nodes {
+		for j := 1; j <= 3; j++ {
+			next := nodes[(i+j)%len(nodes)]
+			nodes[i].DoPing(next.SelfContact.Host, next.SelfContact.Port)
+		}
+	}
+
+	target := NewRandomID()
+	others := make([]ContactDistance, 0, len(nodes)-1)
+	for _, node := range nodes[1:] {
+		others = append(others, ContactDistance{node.SelfContact, node.NodeID.Xor(target)})
+	}
+	want := nodes[0].FindClosestContactsBySort(others)
+
+	found, err := nodes[0].IterativeFindNode(context.Background(), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != len(want) {
+		t.Fatal("ERR: lookup found", len(found), "contacts, want", len(want))
+	}
+	for i := range want {
+		if !found[i].NodeID.Equals(want[i].NodeID) {
+			t.Fatal("ERR: lookup result", i, "is not the", i, "closest node")
+		}
+	}
+
+	//only the closest node to key holds the value
+	key := want[0].NodeID
+	key[IDBytes-1] ^= 1
+	holder := want[0]
+	if err := nodes[1].Store(context.Background(), &holder, key, []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	value, holders, err := nodes[0].IterativeFindValue(context.Background(), key)
+	if err != nil || string(value) != "value" {
+		t.Fatal("ERR: IterativeFindValue did not find the value:", err)
+	}
+	if len(holders) != 1 || !holders[0].NodeID.Equals(holder.NodeID) {
+		t.Error("ERR: IterativeFindValue did not return the node holding the value")
+	}
+	if _, _, err := nodes[0].IterativeFindValue(context.Background(), NewRandomID()); !errors.Is(err, ErrNotFound) {
+		t.Error("ERR: IterativeFindValue of a missing key did not return ErrNotFound:", err)
+	}
+}
+
+func TestCacheAlongLookupPath(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	config := DefaultConfig()
+	config.Clock = clock
+	//searcher only knows middle, middle knows holder
+	holderID := NewRandomID()
+	holder := NewKademliaWithConfig(holderID, "localhost:0", config)
+	middle := NewKademliaWithConfig(NewRandomID(), "localhost:0", config)
+	searcher := NewKademliaWithConfig(NewRandomID(), "localhost:0", config)
+	defer closeNetwork([]*Kademlia{holder, middle, searcher})
+	middle.DoPing(holder.SelfContact.Host, holder.SelfContact.Port)
+	searcher.DoPing(middle.SelfContact.Host, middle.SelfContact.Port)
+
+	key := holderID
+	key[IDBytes-1] ^= 1
+	short := holderID
+	short[IDBytes-1] ^= 2
+	contact := holder.SelfContact
+	if err := middle.Store(context.Background(), &contact, key, []byte("value"), 8*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := middle.Store(context.Background(), &contact, short, []byte("value"), 3*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := searcher.IterativeFindValue(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	//halved for middle and once more for holder, which is closer
+	expires, ok := storedExpiry(middle, key)
+	if !ok {
+		t.Fatal("ERR: found value was not cached on the closest node without it")
+	}
+	if !expires.Equal(start.Add(2 * time.Hour)) {
+		t.Error("ERR: cached value expires at", expires, "want", start.Add(2*time.Hour))
+	}
+
+	if _, _, err := searcher.IterativeFindValue(context.Background(), short); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := storedExpiry(middle, short); ok {
+		t.Error("ERR: value about to expire was cached")
+	}
+}
+
+func TestIterativeFindValues(t *testing.T) {
+	ids := []ID{NewRandomID(), NewRandomID(), NewRandomID(), NewRandomID(), NewRandomID(), NewRandomID()}
+	nodes := startNetwork(DefaultConfig(), ids)
+	defer closeNetwork(nodes)
+
+	vdo, err := VanishData(context.Background(), nodes[0], []byte("Hello World"), 5, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	location := CalculateSharedKeyLocations(vdo.LocationSeed, vdo.Epoch, 5)[0]
+	share, err := nodes[1].LocalValue(location)
+	if err != nil {
+		t.Fatal("ERR: share was not stored on every node:", err)
+	}
+	//the publisher keeps no share, three nodes return the right one and two
+	//the same wrong one
+	forged := append([]byte{share[0]}, GenerateRandomCryptoKey()[:len(share)-1]...)
+	nodes[1].storeValue(location, forged, time.Hour)
+	nodes[2].storeValue(location, forged, time.Hour)
+
+	values, _, err := nodes[0].IterativeFindValues(context.Background(), location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 {
+		t.Fatal("ERR: IterativeFindValues returned", len(values), "values, want 2")
+	}
+	if !bytes.Equal(values[0].Value, share) || len(values[0].Holders) != 3 {
+		t.Error("ERR: the share most nodes returned is not first")
+	}
+	if !bytes.Equal(values[1].Value, forged) || len(values[1].Holders) != 2 {
+		t.Error("ERR: the forged share was not returned with its holders")
+	}
+	if _, _, err := nodes[0].IterativeFindValues(context.Background(), NewRandomID()); !errors.Is(err, ErrNotFound) {
+		t.Error("ERR: IterativeFindValues of a missing key did not return ErrNotFound:", err)
+	}
+
+	data, err := UnvanishData(context.Background(), nodes[0], vdo)
+	if err != nil || string(data) != "Hello World" {
+		t.Error("ERR: unable to unvanish with a forged share:", err)
+	}
+}
+
+func TestBatchStoreAndFind(t *testing.T) {
+	ids := []ID{NewRandomID(), NewRandomID(), NewRandomID(), NewRandomID(), NewRandomID()}
+	nodes := startNetwork(DefaultConfig(), ids)
+	defer closeNetwork(nodes)
+
+	values := make(map[ID][]byte)
+	keys := make([]ID, 0, 50)
+	for i := 0; i < 50; i++ {
+		key := NewRandomID()
+		values[key] = []byte("value" + strconv.Itoa(i))
+		keys = append(keys, key)
+	}
+	//the RPCs the other nodes served of each method
+	served := func(method string) (n uint64) {
+		for _, node := range nodes[1:] {
+			n += node.RPCStats().Served[method]
+		}
+		return
+	}
+
+	if _, err := nodes[0].IterativeStoreBatch(context.Background(), values, 0); err != nil {
+		t.Fatal(err)
+	}
+	//with so few nodes every node is among the closest to every key
+	for _, node := range nodes[1:] {
+		for key, value := range values {
+			if stored, err := node.LocalValue(key); err != nil || !bytes.Equal(stored, value) {
+				t.Fatal("ERR: IterativeStoreBatch did not store every value on the closest nodes")
+			}
+		}
+		//and gets them all in one RPC
+		if stats := node.RPCStats(); stats.Served["StoreBatch"] != 1 || stats.Served["Store"] != 0 {
+			t.Error("ERR: node got", stats.Served["StoreBatch"], "StoreBatch and", stats.Served["Store"], "Store RPCs for", len(values), "values, want one StoreBatch")
+		}
+	}
+	//each lookup round asks a node about all its keys at once
+	if n := served("FindNodeBatch"); n == 0 || n >= uint64(len(values)) || served("FindNode") != 0 || served("FindValueBatch") != 0 {
+		t.Error("ERR:", n, "FindNodeBatch RPCs to look up", len(values), "keys")
+	}
+	lookups := served("FindValueBatch")
+
+	missing := NewRandomID()
+	found, err := nodes[0].IterativeFindValuesBatch(context.Background(), append(keys, missing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != len(keys)+1 {
+		t.Fatal("ERR: IterativeFindValuesBatch returned", len(found), "results for", len(keys)+1, "keys")
+	}
+	for i, key := range keys {
+		if len(found[i]) != 1 || !bytes.Equal(found[i][0].Value, values[key]) || len(found[i][0].Holders) != len(nodes)-1 {
+			t.Fatal("ERR: IterativeFindValuesBatch did not find the value of key", i, "on every node")
+		}
+	}
+	if found[len(keys)] != nil {
+		t.Error("ERR: IterativeFindValuesBatch found a value for a missing key")
+	}
+	if n := served("FindValueBatch") - lookups; n == 0 || n >= uint64(len(keys)) || served("FindValue") != 0 {
+		t.Error("ERR:", n, "FindValueBatch RPCs to find", len(keys)+1, "keys")
+	}
+
+	//a node holding a value still answers a node lookup with closer nodes
+	searcher, holder := NewKademlia(NewRandomID(), "localhost:0"), nodes[1]
+	defer searcher.Close()
+	searcher.DoPing(holder.SelfContact.Host, holder.SelfContact.Port)
+	results, err := searcher.lookupBatch(context.Background(), keys[:1], lookupNodes)
+	if err != nil || len(results[0].closest) != len(nodes) {
+		t.Error("ERR: node lookup found", len(results[0].closest), "of the", len(nodes), "nodes past one holding the value:", err)
+	}
+
+	vdo, err := VanishData(context.Background(), nodes[1], []byte("Hello World"), 50, 25, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := UnvanishData(context.Background(), nodes[2], vdo)
+	if err != nil || string(data) != "Hello World" {
+		t.Error("ERR: unable to unvanish a VDO with 50 shares:", err)
+	}
+}
+
+func TestLogStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.log")
+	store, err := OpenLogStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Unix(1000, 0)
+	key1, key2 := NewRandomID(), NewRandomID()
+	store.Put(key1, StoreEntry{Value: []byte("old"), Expires: expires})
+	store.Put(key1, StoreEntry{Value: []byte("new"), Expires: expires})
+	store.Put(key2, StoreEntry{Value: []byte("deleted")})
+	store.Delete(key2)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(key2, StoreEntry{}); err != ErrStoreClosed {
+		t.Error("ERR: Put on a closed store did not return ErrStoreClosed:", err)
+	}
+	//overwritten and deleted values are scrubbed from the log right away
+	data, _ := os.ReadFile(path)
+	if bytes.Contains(data, []byte("old")) || bytes.Contains(data, []byte("deleted")) {
+		t.Error("ERR: overwritten or deleted value still in the log")
+	}
+
+	//a torn record at the end is cut off
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write(encodeLogRecord(LOG_OP_PUT, key2, StoreEntry{Value: []byte("torn")})[:10])
+	f.Close()
+	store, err = OpenLogStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, ok, _ := store.Get(key1)
+	if !ok || string(entry.Value) != "new" || !entry.Expires.Equal(expires) || !entry.Stored.IsZero() {
+		t.Error("ERR: reopened log store lost the last value put")
+	}
+	if _, ok, _ := store.Get(key2); ok {
+		t.Error("ERR: reopened log store kept a deleted or torn value")
+	}
+	store.Put(key2, StoreEntry{Value: []byte("after")})
+
+	if err := store.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(path)
+	if info.Size() != 2*logHeaderBytes+int64(len("new")+len("after")) {
+		t.Error("ERR: compacted log has", info.Size(), "bytes")
+	}
+	store.Close()
+	store, err = OpenLogStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if storeLen(store) != 2 {
+		t.Error("ERR: compacted log store has", storeLen(store), "values, want 2")
+	}
+}
+
+func TestPersistentNode(t *testing.T) {
+	config := DefaultConfig()
+	config.OpenStore = LogStoreOpener(t.TempDir())
+	instance1 := NewKademliaWithConfig(NewRandomID(), "localhost:0", config)
+	instance2 := NewKademlia(NewRandomID(), "localhost:0")
+	defer instance2.Close()
+	instance1.DoPing(instance2.SelfContact.Host, instance2.SelfContact.Port)
+
+	key, vdoID := NewRandomID(), NewRandomID()
+	if err := instance1.storeValue(key, []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if response := instance1.DoVanishData(vdoID, []byte("Hello World"), 5, 3, 0); response != "ok" {
+		t.Fatal("ERR: vanish failed:", response)
+	}
+	published := NewRandomID()
+	if _, err := instance1.IterativeStore(context.Background(), published, []byte("published"), 0); err != nil {
+		t.Fatal(err)
+	}
+	instance1.Close()
+
+	//the same stores opened by a new node, the shares are on instance2
+	restarted := NewKademliaWithConfig(NewRandomID(), "localhost:0", config)
+	defer restarted.Close()
+	restarted.DoPing(instance2.SelfContact.Host, instance2.SelfContact.Port)
+	if value, err := restarted.LocalValue(key); err != nil || string(value) != "value" {
+		t.Error("ERR: restarted node lost a stored value:", err)
+	}
+	if _, ok, _ := restarted.published.Get(published); !ok {
+		t.Error("ERR: restarted node lost the values it published")
+	}
+	contact := restarted.SelfContact
+	vdo, err := instance2.GetVDO(context.Background(), &contact, vdoID)
+	if err != nil {
+		t.Fatal("ERR: restarted node lost a VDO:", err)
+	}
+	if data, err := UnvanishData(context.Background(), restarted, vdo); err != nil || string(data) != "Hello World" {
+		t.Error("ERR: unable to unvanish a VDO kept across a restart:", err)
+	}
+}
+
+func TestPublishedLogScrubbed(t *testing.T) {
+	clock := newFakeClock()
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.Clock = clock
+	config.OpenStore = LogStoreOpener(dir)
+	publisher := NewKademliaWithConfig(NewRandomID(), "localhost:0", config)
+	peer := NewKademlia(NewRandomID(), "localhost:0")
+	defer closeNetwork([]*Kademlia{publisher, peer})
+	publisher.DoPing(peer.SelfContact.Host, peer.SelfContact.Port)
+	ctx := context.Background()
+	path := filepath.Join(dir, STORE_PUBLISHED+".log")
+
+	//key shares never reach the log
+	if _, err := VanishData(ctx, publisher, []byte("Hello World"), 5, 3, 0); err != nil {
+		t.Fatal("ERR: vanish failed:", err)
+	}
+	if data, _ := os.ReadFile(path); len(data) != 0 {
+		t.Error("ERR: key shares were written to the published log")
+	}
+
+	//a published value is scrubbed from the log once its lifetime is over
+	if _, err := publisher.IterativeStore(ctx, NewRandomID(), []byte("published secret"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); !bytes.Contains(data, []byte("published secret")) {
+		t.Fatal("ERR: published value not in the log")
+	}
+	clock.Advance(time.Hour)
+	if !eventually(5*time.Second, func() bool {
+		clock.Advance(config.SweepInterval)
+		data, _ := os.ReadFile(path)
+		return !bytes.Contains(data, []byte("published secret"))
+	}) {
+		t.Error("ERR: published value still in the log past its lifetime")
+	}
+}
+
+func TestStoreQuotas(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxValueSize = 10
+	config.MaxStoreBytes = 30
+	config.MaxKeysPerSender = 3
+	instance1 := NewKademliaWithConfig(NewRandomID(), "localhost:0", config)
+	instance2 := NewKademlia(NewRandomID(), "localhost:0")
+	defer closeNetwork([]*Kademlia{instance1, instance2})
+	contact1 := instance1.SelfContact
+	ctx := context.Background()
+
+	//refusals cross the wire typed
+	err := instance2.Store(ctx, &contact1, NewRandomID(), make([]byte, 11), 0)
+	var refused *StoreRefusedError
+	if !errors.Is(err, ErrStoreRefused) || !errors.As(err, &refused) || refused.Reason != REFUSED_VALUE_TOO_LARGE {
+		t.Error("ERR: value over MaxValueSize was not refused as too large:", err)
+	}
+	keys := []ID{NewRandomID(), NewRandomID(), NewRandomID(), NewRandomID()}
+	items := []StoreItem{{keys[0], []byte("12345"), 0}, {NewRandomID(), make([]byte, 11), 0}}
+	if indexes, err := instance2.StoreBatch(ctx, &contact1, items); !errors.Is(err, ErrStoreRefused) || len(indexes) != 1 || indexes[0] != 1 {
+		t.Error("ERR: StoreBatch did not report the refused item:", indexes, err)
+	}
+
+	//keys per sender
+	for _, key := range keys[1:3] {
+		if err := instance2.Store(ctx, &contact1, key, []byte("12345"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = instance2.Store(ctx, &contact1, keys[3], []byte("12345"), 0)
+	if !errors.As(err, &refused) || refused.Reason != REFUSED_SENDER_QUOTA {
+		t.Error("ERR: key over MaxKeysPerSender was not refused:", err)
+	}
+	if err := instance2.Store(ctx, &contact1, keys[1], []byte("54321"), 0); err != nil {
+		t.Error("ERR: sender over its quota could not store a key it holds again:", err)
+	}
+	//another NodeID claiming another Host is still counted by the IP its
+	//request came from
+	instance3 := NewKademlia(NewRandomID(), "localhost:0")
+	defer instance3.Close()
+	req := StoreRequest{Sender: Contact{instance3.NodeID, net.IPv4(10, 1, 2, 3), 8163}, MsgID: NewRandomID(), Key: keys[3], Value: []byte("12345")}
+	var res StoreResult
+	if err := instance3.call(ctx, contact1, "Store", &req, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.As(res.Err, &refused) || refused.Reason != REFUSED_SENDER_QUOTA {
+		t.Error("ERR: key over MaxKeysPerSender from a sender claiming another Host was not refused:", res.Err)
+	}
+
+	//total bytes, 15 stored by instance2 for DefaultValueTTL
+	soon, later, sooner := NewRandomID(), NewRandomID(), NewRandomID()
+	if err := instance1.storeValue(soon, make([]byte, 10), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := instance1.storeValue(later, make([]byte, 10), 2*time.Hour); err != nil {
+		t.Fatal("ERR: value was not stored by evicting the one expiring first:", err)
+	}
+	if _, err := instance1.LocalValue(soon); err == nil {
+		t.Error("ERR: the value expiring first was not evicted")
+	}
+	if _, err := instance1.LocalValue(keys[0]); err != nil {
+		t.Error("ERR: a value expiring later was evicted")
+	}
+	err = instance1.storeValue(sooner, make([]byte, 10), 30*time.Minute)
+	if !errors.As(err, &refused) || refused.Reason != REFUSED_STORE_FULL {
+		t.Error("ERR: value expiring before every other was stored in a full node:", err)
+	}
+}
+
+func TestQuotaVictims(t *testing.T) {
+	q := newStoreQuota(NewMemoryStore())
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	keys := make([]ID, 100)
+	for i, j := range rand.Perm(len(keys)) {
+		keys[j] = NewRandomID()
+		q.add(keys[j], quotaEntry{size: 10, expires: start.Add(time.Duration(j) * time.Minute)})
+		if i%10 == 0 {
+			q.remove(keys[j])
+			q.add(keys[j], quotaEntry{size: 10, expires: start.Add(time.Duration(j) * time.Minute)})
+		}
+	}
+
+	victims, ok := q.victims(keys[1], 25, start.Add(time.Hour))
+	if !ok || len(victims) != 3 || victims[0] != keys[0] || victims[1] != keys[2] || victims[2] != keys[3] {
+		t.Error("ERR: victims are not the values expiring first, skipping the key stored again:", victims, ok)
+	}
+	if _, ok := q.victims(keys[1], 25, start.Add(2*time.Minute)); ok {
+		t.Error("ERR: values expiring after the new one were evicted")
+	}
+	if victims, ok := q.victims(keys[1], 991, start.Add(2*time.Hour)); ok || len(victims) != 99 {
+		t.Error("ERR: victims freed more than the values expiring before the new one:", len(victims), ok)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	clock := newFakeClock()
+	config := DefaultConfig()
+	config.Clock = clock
+	config.IPRequestRate, config.IPRequestBurst = 1, 5
+	config.NodeRequestRate, config.NodeRequestBurst = 1, 3
+	instance1 := NewKademliaWithConfig(NewRandomID(), "localhost:0", config)
+	instance2 := NewKademlia(NewRandomID(), "localhost:0")
+	instance3 := NewKademlia(NewRandomID(), "localhost:0")
+	defer closeNetwork([]*Kademlia{instance1, instance2, instance3})
+	host, port := instance1.SelfContact.Host, instance1.SelfContact.Port
+	ctx := context.Background()
+
+	//three tokens for instance2's NodeID, the refused ping still costs an
+	//IP token
+	for i := 0; i < 3; i++ {
+		if _, err := instance2.Ping(ctx, host, port); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := instance2.Ping(ctx, host, port); !errors.Is(err, ErrRateLimited) {
+		t.Error("ERR: ping over the NodeID limit did not return ErrRateLimited:", err)
+	}
+	//one IP token left for a node on the same IP
+	if _, err := instance3.Ping(ctx, host, port); err != nil {
+		t.Error("ERR: ping within the IP limit failed:", err)
+	}
+	if _, err := instance3.Ping(ctx, host, port); !errors.Is(err, ErrRateLimited) {
+		t.Error("ERR: ping over the IP limit did not return ErrRateLimited:", err)
+	}
+	clock.Advance(2 * time.Second)
+	if _, err := instance3.Ping(ctx, host, port); err != nil {
+		t.Error("ERR: ping after the buckets refilled failed:", err)
+	}
+
+	//batches cost one token per key
+	clock.Advance(time.Hour)
+	contact1 := instance1.SelfContact
+	if _, err := instance2.FindValueBatch(ctx, &contact1, []ID{NewRandomID(), NewRandomID(), NewRandomID(), NewRandomID()}); !errors.Is(err, ErrRateLimited) {
+		t.Error("ERR: batch costing more than the NodeID burst did not return ErrRateLimited:", err)
+	}
+
+	stats := instance1.RPCStats()
+	if stats.Served["Ping"] != 5 || stats.Limited["Ping"] != 2 || stats.Limited["FindValueBatch"] != 1 {
+		t.Error("ERR: wrong RPC stats", stats)
+	}
+
+	//requests claiming instance2's NodeID from another host don't use up
+	//its tokens
+	clock.Advance(time.Hour)
+	spoofed := instance2.SelfContact
+	spoofed.Host = net.IPv4(10, 1, 2, 3)
+	for i := 0; i < 3; i++ {
+		ping := &PingMessage{Sender: spoofed, MsgID: NewRandomID()}
+		if err := instance3.call(ctx, contact1, "Ping", ping, &PongMessage{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := instance2.Ping(ctx, host, port); err != nil {
+		t.Error("ERR: requests claiming another host used up the NodeID's tokens:", err)
+	}
+}
+
+func TestSenderVerification(t *testing.T) {
+	instance1 := NewKademlia(NewRandomID(), "localhost:0")
+	instance2 := NewKademlia(NewRandomID(), "localhost:0")
+	instance3 := NewKademlia(NewRandomID(), "localhost:0")
+	defer closeNetwork([]*Kademlia{instance1, instance2, instance3})
+	host, port := instance1.SelfContact.Host, instance1.SelfContact.Port
+	ctx := context.Background()
+	pingAs := func(sender Contact) {
+		ping := PingMessage{Sender: sender, MsgID: NewRandomID()}
+		var pong PongMessage
+		if err := instance2.call(ctx, instance1.SelfContact, "Ping", ping, &pong); err != nil {
+			t.Fatal(err)
+		}
+		confirmed(instance1)
+	}
+
+	//a sender claiming another host than the request came from is ignored,
+	//even when that host would answer
+	instance1.senderSeen(instance3.SelfContact, net.IPv4(10, 1, 2, 3))
+	if _, err := instance1.FindContact(instance3.NodeID); err == nil {
+		t.Error("ERR: sender claiming another host was added")
+	}
+	spoofed := Contact{NewRandomID(), net.IPv4(10, 1, 2, 3), 8163}
+	pingAs(spoofed)
+	if _, err := instance1.FindContact(spoofed.NodeID); err == nil {
+		t.Error("ERR: sender claiming another host was added")
+	}
+	//a sender that doesn't answer from the NodeID it claimed is not added
+	impostor := Contact{NewRandomID(), instance3.SelfContact.Host, instance3.SelfContact.Port}
+	pingAs(impostor)
+	if _, err := instance1.FindContact(impostor.NodeID); err == nil {
+		t.Error("ERR: sender answering with another NodeID was added")
+	}
+
+	//a sender that answers is added once it has answered our ping
+	if _, err := instance2.Ping(ctx, host, port); err != nil {
+		t.Fatal(err)
+	}
+	confirmed(instance1)
+	if _, err := instance1.FindContact(instance2.NodeID); err != nil {
+		t.Error("ERR: confirmed sender was not added")
+	}
+	//a known NodeID claimed at another address doesn't move
+	pingAs(Contact{instance2.NodeID, instance3.SelfContact.Host, instance3.SelfContact.Port})
+	if c, err := instance1.FindContact(instance2.NodeID); err != nil || c.Port != instance2.SelfContact.Port {
+		t.Error("ERR: known contact moved to the address another sender claimed for it:", c, err)
+	}
+}
+
+func TestNodeIdentities(t *testing.T) {
+	identity, err := GenerateIdentity(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := identity.NodeID(); id != ID(sha1.Sum(identity.PublicKey)) || !puzzleSolved(id, 4) {
+		t.Error("ERR: generated NodeID is not the hash of its key or doesn't solve the puzzle")
+	}
+	path := filepath.Join(t.TempDir(), "identity.key")
+	saved, err := LoadIdentity(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadIdentity(path, 4)
+	if err != nil || loaded.NodeID() != saved.NodeID() {
+		t.Error("ERR: identity did not load back with the same NodeID:", err)
+	}
+
+	//a signed message no longer verifies once changed
+	req := &StoreRequest{Sender: Contact{NodeID: identity.NodeID()}, Key: NewRandomID(), Value: []byte("share")}
+	if err := identity.sign("Store", req, NewRandomID(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySignature("Store", req, identity.NodeID(), 4); err != nil {
+		t.Error("ERR: signed message did not verify:", err)
+	}
+	if err := verifySignature("FindValue", req, identity.NodeID(), 4); err != ErrBadSignature {
+		t.Error("ERR: message verified as sent to another method")
+	}
+	req.Value = []byte("other")
+	if err := verifySignature("Store", req, identity.NodeID(), 4); err != ErrBadSignature {
+		t.Error("ERR: changed message verified")
+	}
+	req.Value = []byte("share")
+	req.To = NewRandomID()
+	if err := verifySignature("Store", req, identity.NodeID(), 4); err != ErrBadSignature {
+		t.Error("ERR: message verified for another recipient")
+	}
+
+	config := DefaultConfig()
+	config.VerifyNodeIDs, config.IDPuzzleBits = true, 4
+	identity2, err := GenerateIdentity(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance1 := NewKademliaWithIdentity(identity, "localhost:0", config)
+	instance2 := NewKademliaWithIdentity(identity2, "localhost:0", config)
+	instance3 := NewKademliaWithConfig(NewRandomID(), "localhost:0", config)
+	defer closeNetwork([]*Kademlia{instance1, instance2, instance3})
+	host, port := instance1.SelfContact.Host, instance1.SelfContact.Port
+	ctx := context.Background()
+
+	if _, err := instance2.Ping(ctx, host, port); err != nil {
+		t.Fatal(err)
+	}
+	confirmed(instance1)
+	if _, err := instance1.FindContact(instance2.NodeID); err != nil {
+		t.Error("ERR: node with a bound NodeID was not added")
+	}
+	//a NodeID not bound to the key signing the request is refused
+	if _, err := instance3.Ping(ctx, host, port); !errors.Is(err, ErrBadSignature) {
+		t.Error("ERR: ping from a node with an unbound NodeID did not return ErrBadSignature:", err)
+	}
+	if _, err := instance1.FindContact(instance3.NodeID); err == nil {
+		t.Error("ERR: node with an unbound NodeID was added")
+	}
+	//and so is its pong
+	if _, err := instance1.Ping(ctx, instance3.SelfContact.Host, instance3.SelfContact.Port); !errors.Is(err, ErrBadSignature) {
+		t.Error("ERR: pong from a node with an unbound NodeID did not return ErrBadSignature:", err)
+	}
+	//responses are signed by the node we asked
+	contact1 := instance1.SelfContact
+	if _, err := instance2.FindNode(ctx, &contact1, NewRandomID()); err != nil {
+		t.Error("ERR: signed response was not taken:", err)
+	}
+	impostor := Contact{identity2.NodeID(), host, port}
+	if _, err := instance2.FindNode(ctx, &impostor, NewRandomID()); !errors.Is(err, ErrBadSignature) {
+		t.Error("ERR: response signed by another node than the one asked did not return ErrBadSignature:", err)
+	}
+
+	//requests signed for another node, long ago or already taken are refused
+	client, err := dialHTTPPath(ctx, host.String()+":"+strconv.Itoa(int(port)), rpc.DefaultRPCPath+strconv.Itoa(int(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sendSigned := func(to ID, at time.Time) func() error {
+		ping := &PingMessage{Sender: instance2.SelfContact, MsgID: NewRandomID()}
+		ping.Nonce = NewRandomID()
+		if err := identity2.sign("Ping", ping, to, at); err != nil {
+			t.Fatal(err)
+		}
+		return func() error {
+			var pong PongMessage
+			return serverError(client.Call("KademliaCore.Ping", ping, &pong))
+		}
+	}
+	if err := sendSigned(instance3.NodeID, time.Now())(); !errors.Is(err, ErrBadSignature) {
+		t.Error("ERR: request signed for another node did not return ErrBadSignature:", err)
+	}
+	if err := sendSigned(instance1.NodeID, time.Now().Add(-2*SIGNATURE_WINDOW))(); !errors.Is(err, ErrStaleMessage) {
+		t.Error("ERR: request signed long ago did not return ErrStaleMessage:", err)
+	}
+	replay := sendSigned(instance1.NodeID, time.Now())
+	if err := replay(); err != nil {
+		t.Error("ERR: fresh request was refused:", err)
+	}
+	if err := replay(); !errors.Is(err, ErrStaleMessage) {
+		t.Error("ERR: replayed request did not return ErrStaleMessage:", err)
+	}
+}
+
+func TestVanishWithoutPeers(t *testing.T) {
+	instance := NewKademlia(NewRandomID(), "localhost:0")
+	defer instance.Close()
+	ctx := context.Background()
+
+	if _, err := VanishReader(ctx, instance, bytes.NewReader([]byte("Hello World")), 5, 3, 0); err == nil {
+		t.Error("ERR: vanished with no node to store the key shares on")
+	}
+	if vdo, err := VanishData(ctx, instance, []byte("Hello World"), 5, 3, 0); err == nil || len(vdo.Ciphertext) != 0 {
+		t.Error("ERR: VanishData returned a VDO whose key shares were not stored")
+	}
+	if response := instance.DoVanishData(NewRandomID(), []byte("Hello World"), 5, 3, 0); !strings.Contains(response, "key shares stored") {
+		t.Error("ERR: DoVanishData did not report why vanishing failed:", response)
+	}
+}
+
+func TestStoreBatchSpares(t *testing.T) {
+	//the MAX_BUCKET_SIZE closest nodes to the key are full, the next one
+	//closest has room
+	full := DefaultConfig()
+	full.MaxStoreBytes = 1
+	publisher := NewKademlia(NewRandomID(), "localhost:0")
+	nodes := []*Kademlia{publisher, NewKademlia(NewRandomID(), "localhost:0")}
+	for i := 0; i < MAX_BUCKET_SIZE; i++ {
+		nodes = append(nodes, NewKademliaWithConfig(NewRandomID(), "localhost:0", full))
+	}
+	defer closeNetwork(nodes)
+	for _, node := range nodes[1:] {
+		if _, err := publisher.Ping(context.Background(), node.SelfContact.Host, node.SelfContact.Port); err != nil {
+			t.Fatal(err)
+		}
+	}
+	spare := nodes[1]
+	var key ID
+	for farthest := false; !farthest; {
+		key = NewRandomID()
+		farthest = true
+		for _, node := range nodes[2:] {
+			if node.NodeID.Xor(key).Compare(spare.NodeID.Xor(key)) > 0 {
+				farthest = false
+			}
+		}
+	}
+
+	stored, err := publisher.IterativeStoreBatch(context.Background(), map[ID][]byte{key: []byte("share")}, 0)
+	if stored != 1 {
+		t.Error("ERR: value refused by the closest nodes was not stored on a spare:", err)
+	}
+	if _, err := spare.LocalValue(key); err != nil {
+		t.Error("ERR: spare node does not hold the value:", err)
+	}
+}
+
 func TestIterativeFindFunctions(t *testing.T) {
 	fmt.Println(".........Begin test find node......")
 	numberOfNodes := 20
 
 	numberOfContactsPerNode := 20
-	instances := make([]Kademlia, numberOfNodes)
-	instancesAddr := make([]string, numberOfNodes)
-	startPort := 8000
+	instances := make([]*Kademlia, numberOfNodes)
 
 	//testerNumber := int(rand.Intn(numberOfNodes))
 	//testSearchNumber := int(rand.Intn(numberOfNodes))
@@ -208,20 +1542,15 @@ func TestIterativeFindFunctions(t *testing.T) {
 
 	//create 100 kademlia instance
 	for i := 0; i < numberOfNodes; i++ {
-		port := i + startPort
-		address := "localhost:" + strconv.Itoa(port)
-
-		// fmt.Println("port is " + address)
-		instancesAddr[i] = address
-		instances[i] = *NewKademlia(CreateIdForTest(string(i)), address)
-		//instances[i] = *NewKademlia(CreateIdForTest(strconv.Itoa(i)), address)
+		instances[i] = NewKademlia(CreateIdForTest(string(rune(i))), "localhost:0")
+		//instances[i] = NewKademlia(CreateIdForTest(strconv.Itoa(i)), address)
 	}
+	defer closeNetwork(instances)
 
 	fmt.Println("Ping .........")
 
 	for i := 0; i < numberOfNodes; i++ {
-		address := instancesAddr[i]
-		host, port, _ := StringToIpPort(address)
+		host, port := instances[i].SelfContact.Host, instances[i].SelfContact.Port
 		start := i - numberOfContactsPerNode/2
 		end := i + numberOfContactsPerNode/2
 		if i >= numberOfContactsPerNode/2 && i <= numberOfNodes-numberOfContactsPerNode/2 {
@@ -259,3 +1588,213 @@ func TestIterativeFindFunctions(t *testing.T) {
 
 	return
 }
+
+func TestVDOCiphertext(t *testing.T) {
+	key := GenerateRandomCryptoKey()
+	data := []byte("Hello World")
+
+	vdo := VanashingDataObject{Version: VDO_VERSION, NumberKeys: 20, Threshold: 10, Epoch: epochStart(time.Now(), 0)}
+	vdo.Ciphertext = seal(key, data, vdoAssociatedData(&vdo))
+	res, err := decryptVDO(key, &vdo)
+	if err != nil || string(res) != string(data) {
+		t.Error("ERR: unable to open sealed VDO")
+	}
+
+	//wrong key
+	if _, err := decryptVDO(GenerateRandomCryptoKey(), &vdo); err != ErrVDOExpired {
+		t.Error("ERR: opened VDO with the wrong key")
+	}
+
+	//tampered metadata
+	tampered := vdo
+	tampered.Threshold = 2
+	if _, err := decryptVDO(key, &tampered); err != ErrVDOExpired {
+		t.Error("ERR: opened VDO with tampered threshold")
+	}
+
+	//old AES-CFB objects can still be read
+	block, _ := aes.NewCipher(key)
+	legacy := make([]byte, aes.BlockSize+len(data))
+	cipher.NewCFBEncrypter(block, legacy[:aes.BlockSize]).XORKeyStream(legacy[aes.BlockSize:], data)
+	old := VanashingDataObject{Version: VDO_VERSION_CFB, Ciphertext: legacy}
+	res, err = decryptVDO(key, &old)
+	if err != nil || string(res) != string(data) {
+		t.Error("ERR: unable to read legacy VDO")
+	}
+}
+
+func TestVDOStreamCiphertext(t *testing.T) {
+	key := GenerateRandomCryptoKey()
+	ad := []byte("metadata")
+	for _, size := range []int{0, 1, VDO_SEGMENT_BYTES, VDO_SEGMENT_BYTES + 1, 3 * VDO_SEGMENT_BYTES} {
+		data := make([]byte, size)
+		rand.Read(data)
+		ciphertext, err := sealStream(key, bytes.NewReader(data), ad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := openStream(key, ciphertext, ad, &out, false); err != nil || !bytes.Equal(out.Bytes(), data) {
+			t.Error("ERR: unable to open stream of " + strconv.Itoa(size) + " bytes")
+		}
+		if size > VDO_SEGMENT_BYTES {
+			//drop the last segment
+			truncated := ciphertext[:streamPrefixBytes+VDO_SEGMENT_BYTES+16]
+			if err := openStream(key, truncated, ad, new(bytes.Buffer), false); err != ErrVDOExpired {
+				t.Error("ERR: opened truncated stream")
+			}
+		}
+	}
+}
+
+func TestSharedKeyLocations(t *testing.T) {
+	accessKey := GenerateRandomAccessKey()
+	epoch := epochStart(time.Now(), 0)
+	ids := CalculateSharedKeyLocations(accessKey, epoch, 20)
+	again := CalculateSharedKeyLocations(accessKey, epoch, 20)
+	next := CalculateSharedKeyLocations(accessKey, epochStart(time.Now(), 1), 20)
+	other := CalculateSharedKeyLocations(GenerateRandomAccessKey(), epoch, 20)
+	for i := range ids {
+		if !ids[i].Equals(again[i]) {
+			t.Error("ERR: locations are not deterministic")
+		}
+		if ids[i].Equals(next[i]) || ids[i].Equals(other[i]) {
+			t.Error("ERR: locations shared across epochs or VDOs")
+		}
+	}
+}
+
+func TestEpochs(t *testing.T) {
+	//the same instant falls in the same epoch whatever the time zone
+	utc := time.Date(2015, 3, 29, 4, 30, 0, 0, time.UTC)
+	want := time.Date(2015, 3, 29, 0, 0, 0, 0, time.UTC).Unix()
+	for _, zone := range []*time.Location{time.UTC, time.FixedZone("IST", 5*3600+1800), time.FixedZone("PDT", -7*3600)} {
+		if epoch := epochStart(utc.In(zone), 0); epoch != want {
+			t.Error("ERR: epoch in", zone, "starts at", time.Unix(epoch, 0).UTC(), "want", time.Unix(want, 0).UTC())
+		}
+	}
+	if epochStart(utc, 1)-epochStart(utc, -1) != int64(2*EPOCH_LENGTH/time.Second) {
+		t.Error("ERR: epochs are not EPOCH_LENGTH apart")
+	}
+
+	//a node reads the current epoch from its clock
+	clock := newFakeClock()
+	config := DefaultConfig()
+	config.Clock = clock
+	instance := NewKademliaWithConfig(NewRandomID(), "localhost:0", config)
+	defer instance.Close()
+	start := instance.epoch(0)
+	clock.Advance(EPOCH_LENGTH - time.Second)
+	if instance.epoch(0) != start {
+		t.Error("ERR: epoch changed before EPOCH_LENGTH passed")
+	}
+	clock.Advance(time.Second)
+	if instance.epoch(0) != start+int64(EPOCH_LENGTH/time.Second) {
+		t.Error("ERR: epoch did not change after EPOCH_LENGTH")
+	}
+}
+
+func TestRepublishShares(t *testing.T) {
+	clock := newFakeClock()
+	config := DefaultConfig()
+	config.Clock = clock
+	nodes := startNetwork(config, []ID{NewRandomID(), NewRandomID(), NewRandomID(), NewRandomID()})
+	defer closeNetwork(nodes)
+	stored := func(epoch int64, seed []byte) bool {
+		for _, location := range CalculateSharedKeyLocations(seed, epoch, 5) {
+			for _, node := range nodes {
+				if _, err := node.LocalValue(location); err == nil {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	//valid for 12 hours, so republished at the start of the next epoch only
+	clock.Advance(time.Hour)
+	vdo, err := VanishData(context.Background(), nodes[0], []byte("Hello World"), 5, 3, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(EPOCH_LENGTH - time.Hour)
+	if !eventually(5*time.Second, func() bool { return stored(nodes[0].epoch(0), vdo.LocationSeed) }) {
+		t.Fatal("ERR: key shares were not republished at the start of the epoch")
+	}
+	clock.Advance(EPOCH_LENGTH)
+	time.Sleep(200 * time.Millisecond)
+	if stored(nodes[0].epoch(0), vdo.LocationSeed) {
+		t.Error("ERR: key shares were republished past the valid period")
+	}
+}
+
+func TestVanishTwoObjectsSameEpoch(t *testing.T) {
+	numberOfNodes := 10
+	instances := make([]*Kademlia, numberOfNodes)
+	for i := 0; i < numberOfNodes; i++ {
+		instances[i] = NewKademlia(NewRandomID(), "localhost:0")
+		for j := 0; j < i; j++ {
+			instances[i].DoPing(instances[j].SelfContact.Host, instances[j].SelfContact.Port)
+		}
+	}
+
+	defer closeNetwork(instances)
+
+	instance1 := instances[0]
+	instance2 := instances[numberOfNodes-1]
+	vdoId1 := NewRandomID()
+	vdoId2 := NewRandomID()
+	data1 := "first object"
+	data2 := "second object"
+	instance1.DoVanishData(vdoId1, []byte(data1), byte(5), byte(3), 0)
+	instance1.DoVanishData(vdoId2, []byte(data2), byte(5), byte(3), 0)
+
+	response := instance2.DoUnVanishData(&instance1.SelfContact, vdoId1)
+	if "ok, Unvanish result is: "+data1 != response {
+		t.Error("ERR: first VDO was lost, got " + response)
+	}
+	response = instance2.DoUnVanishData(&instance1.SelfContact, vdoId2)
+	if "ok, Unvanish result is: "+data2 != response {
+		t.Error("ERR: second VDO was lost, got " + response)
+	}
+}
+
+func TestVDOEncoding(t *testing.T) {
+	vdo := VanashingDataObject{
+		Version:      VDO_VERSION,
+		NumberKeys:   20,
+		Threshold:    10,
+		Epoch:        epochStart(time.Now(), 0),
+		LocationSeed: GenerateRandomAccessKey(),
+		Ciphertext:   []byte("not really a ciphertext"),
+	}
+	data, err := MarshalVDO(vdo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := UnmarshalVDO(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Version != vdo.Version || decoded.NumberKeys != vdo.NumberKeys ||
+		decoded.Threshold != vdo.Threshold || decoded.Epoch != vdo.Epoch ||
+		string(decoded.LocationSeed) != string(vdo.LocationSeed) ||
+		string(decoded.Ciphertext) != string(vdo.Ciphertext) {
+		t.Error("ERR: VDO changed after encoding")
+	}
+	if _, err := UnmarshalVDO(data[:len(data)-1]); err != ErrBadVDOFormat {
+		t.Error("ERR: accepted truncated VDO")
+	}
+
+	armored, err := ArmorVDO(vdo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err = UnarmorVDO([]byte("Here is the VDO:\n\n" + armored + "\nBye\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded.Ciphertext) != string(vdo.Ciphertext) {
+		t.Error("ERR: VDO changed after armoring")
+	}
+}
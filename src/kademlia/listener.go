@@ -0,0 +1,56 @@
+package kademlia
+
+// Contains the listener the RPC server runs on. It remembers the connections
+// it accepted, RPC connections are hijacked from the HTTP server so closing
+// the node has to close them itself.
+
+import (
+	"net"
+	"sync"
+)
+
+type trackingListener struct {
+	net.Listener
+	mutex sync.Mutex
+	conns map[net.Conn]bool
+}
+
+type trackedConn struct {
+	net.Conn
+	l *trackingListener
+}
+
+func newTrackingListener(l net.Listener) *trackingListener {
+	return &trackingListener{Listener: l, conns: make(map[net.Conn]bool)}
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &trackedConn{conn, l}
+	l.mutex.Lock()
+	l.conns[c] = true
+	l.mutex.Unlock()
+	return c, nil
+}
+
+//stop accepting and drop every connection accepted so far
+func (l *trackingListener) Close() error {
+	err := l.Listener.Close()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for c := range l.conns {
+		c.(*trackedConn).Conn.Close()
+	}
+	l.conns = make(map[net.Conn]bool)
+	return err
+}
+
+func (c *trackedConn) Close() error {
+	c.l.mutex.Lock()
+	delete(c.l.conns, c)
+	c.l.mutex.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,353 @@
+package kademlia
+
+// Contains LogStore, a Store kept in an append-only log on disk. Every Put
+// and Delete appends a record, and opening the log replays them into an
+// in-memory index. Once most of the log is overwritten or deleted records it
+// is compacted into a new log holding one record per live entry.
+//
+// A record that is overwritten or deleted is scrubbed right away: its op
+// becomes LOG_OP_SCRUBBED and everything but its length is zeroed, so an
+// expired key share doesn't stay readable in the log until the next
+// compaction. Replay skips scrubbed records by their length.
+//
+// All integers are big-endian, times are unix nanoseconds with 0 for the zero
+// time:
+//
+//	checksum    4 bytes  CRC-32 (IEEE) of the rest of the record
+//	length      4 bytes  length of the value
+//	op          1 byte   LOG_OP_PUT, LOG_OP_DELETE or LOG_OP_SCRUBBED
+//	key         IDBytes bytes
+//	expires     8 bytes
+//	stored      8 bytes
+//	value
+//
+// Writes are not synced one by one, a crash may lose the last ones. A torn
+// or corrupt record at the end of the log is cut off when it is opened.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	LOG_OP_PUT      = 1
+	LOG_OP_DELETE   = 2
+	LOG_OP_SCRUBBED = 3
+
+	//dead records are compacted away once there are more of them than live
+	//ones and they take more than this
+	LOG_COMPACT_MIN_GARBAGE = 1 << 20
+
+	logHeaderBytes = 4 + 4 + 1 + IDBytes + 8 + 8
+)
+
+var ErrStoreClosed = errors.New("store is closed")
+
+type LogStore struct {
+	mutex   sync.RWMutex
+	path    string
+	file    *os.File
+	entries map[ID]StoreEntry
+	//where the record of each live entry starts
+	offsets map[ID]int64
+	//bytes in the log and in the records of live entries
+	size   int64
+	live   int64
+	closed bool
+}
+
+// Open the log at path, creating it if needed.
+func OpenLogStore(path string) (*LogStore, error) {
+	s := &LogStore{path: path, entries: make(map[ID]StoreEntry), offsets: make(map[ID]int64)}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	valid := s.replay(data)
+
+	s.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if valid < int64(len(data)) {
+		if err := s.file.Truncate(valid); err != nil {
+			s.file.Close()
+			return nil, err
+		}
+	}
+	s.size = valid
+	return s, nil
+}
+
+// A StoreOpener of LogStores kept in dir as name.log.
+func LogStoreOpener(dir string) StoreOpener {
+	return func(name string) (Store, error) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		return OpenLogStore(filepath.Join(dir, name+".log"))
+	}
+}
+
+//apply the records of data to the index and return how many bytes of it
+//hold whole, valid records
+func (s *LogStore) replay(data []byte) int64 {
+	var offset int64
+	for {
+		op, key, entry, n, ok := decodeLogRecord(data[offset:])
+		if !ok {
+			return offset
+		}
+		start := offset
+		offset += int64(n)
+		if op == LOG_OP_SCRUBBED {
+			continue
+		}
+		if old, ok := s.entries[key]; ok {
+			s.live -= logRecordBytes(old)
+			delete(s.entries, key)
+			delete(s.offsets, key)
+		}
+		if op == LOG_OP_PUT {
+			s.entries[key] = entry
+			s.offsets[key] = start
+			s.live += logRecordBytes(entry)
+		}
+	}
+}
+
+func logRecordBytes(entry StoreEntry) int64 {
+	return int64(logHeaderBytes + len(entry.Value))
+}
+
+func encodeLogTime(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+func decodeLogTime(n uint64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(n))
+}
+
+func encodeLogRecord(op byte, key ID, entry StoreEntry) []byte {
+	record := make([]byte, logHeaderBytes+len(entry.Value))
+	binary.BigEndian.PutUint32(record[4:], uint32(len(entry.Value)))
+	record[8] = op
+	copy(record[9:], key[:])
+	binary.BigEndian.PutUint64(record[9+IDBytes:], encodeLogTime(entry.Expires))
+	binary.BigEndian.PutUint64(record[17+IDBytes:], encodeLogTime(entry.Stored))
+	copy(record[logHeaderBytes:], entry.Value)
+	binary.BigEndian.PutUint32(record, crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+//the record at the start of data and its length, ok is false when data
+//doesn't start with a whole, valid record. Scrubbed records have no
+//checksum, only their op and length are returned.
+func decodeLogRecord(data []byte) (op byte, key ID, entry StoreEntry, n int, ok bool) {
+	if len(data) < logHeaderBytes {
+		return
+	}
+	valueLength := binary.BigEndian.Uint32(data[4:])
+	if uint64(len(data)-logHeaderBytes) < uint64(valueLength) {
+		return
+	}
+	n = logHeaderBytes + int(valueLength)
+	if data[8] == LOG_OP_SCRUBBED {
+		return LOG_OP_SCRUBBED, key, entry, n, true
+	}
+	if crc32.ChecksumIEEE(data[4:n]) != binary.BigEndian.Uint32(data) {
+		return
+	}
+	op = data[8]
+	if op != LOG_OP_PUT && op != LOG_OP_DELETE {
+		return
+	}
+	copy(key[:], data[9:])
+	entry.Expires = decodeLogTime(binary.BigEndian.Uint64(data[9+IDBytes:]))
+	entry.Stored = decodeLogTime(binary.BigEndian.Uint64(data[17+IDBytes:]))
+	entry.Value = append([]byte(nil), data[logHeaderBytes:n]...)
+	return op, key, entry, n, true
+}
+
+//append a record, cutting off what was written of it if the write failed so
+//the records after it can still be read back
+func (s *LogStore) append(op byte, key ID, entry StoreEntry) error {
+	if s.closed {
+		return ErrStoreClosed
+	}
+	record := encodeLogRecord(op, key, entry)
+	if _, err := s.file.WriteAt(record, s.size); err != nil {
+		s.file.Truncate(s.size)
+		return err
+	}
+	s.size += int64(len(record))
+	return nil
+}
+
+//scrub the record of key's live entry, which is about to be replaced or
+//deleted. The op is written first so a scrub cut short by a crash still
+//reads back as scrubbed.
+func (s *LogStore) scrub(key ID) error {
+	offset, ok := s.offsets[key]
+	if !ok {
+		return nil
+	}
+	delete(s.offsets, key)
+	if _, err := s.file.WriteAt([]byte{LOG_OP_SCRUBBED}, offset+8); err != nil {
+		return err
+	}
+	if _, err := s.file.WriteAt(make([]byte, 4), offset); err != nil {
+		return err
+	}
+	_, err := s.file.WriteAt(make([]byte, logRecordBytes(s.entries[key])-9), offset+9)
+	return err
+}
+
+func (s *LogStore) Put(key ID, entry StoreEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	offset := s.size
+	if err := s.append(LOG_OP_PUT, key, entry); err != nil {
+		return err
+	}
+	err := s.scrub(key)
+	if old, ok := s.entries[key]; ok {
+		s.live -= logRecordBytes(old)
+	}
+	s.entries[key] = entry
+	s.offsets[key] = offset
+	s.live += logRecordBytes(entry)
+	s.maybeCompact()
+	return err
+}
+
+func (s *LogStore) Get(key ID) (StoreEntry, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if s.closed {
+		return StoreEntry{}, false, ErrStoreClosed
+	}
+	entry, ok := s.entries[key]
+	return entry, ok, nil
+}
+
+func (s *LogStore) Delete(key ID) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	old, ok := s.entries[key]
+	if !ok {
+		if s.closed {
+			return ErrStoreClosed
+		}
+		return nil
+	}
+	if err := s.append(LOG_OP_DELETE, key, StoreEntry{}); err != nil {
+		return err
+	}
+	err := s.scrub(key)
+	delete(s.entries, key)
+	s.live -= logRecordBytes(old)
+	s.maybeCompact()
+	return err
+}
+
+func (s *LogStore) Iterate(f func(key ID, entry StoreEntry) bool) error {
+	s.mutex.RLock()
+	closed := s.closed
+	s.mutex.RUnlock()
+	if closed {
+		return ErrStoreClosed
+	}
+	return iterateSnapshot(&s.mutex, s.entries, f)
+}
+
+//compact once the log is mostly garbage, a failed compaction is tried again
+//on the next write
+func (s *LogStore) maybeCompact() {
+	garbage := s.size - s.live
+	if garbage >= LOG_COMPACT_MIN_GARBAGE && garbage >= s.live {
+		s.compact()
+	}
+}
+
+// Rewrite the log with one record per live entry.
+func (s *LogStore) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	return s.compact()
+}
+
+//write the live entries to a new log and rename it over the old one, which
+//is left as it was if anything fails
+func (s *LogStore) compact() error {
+	var buf bytes.Buffer
+	offsets := make(map[ID]int64, len(s.entries))
+	for key, entry := range s.entries {
+		offsets[key] = int64(buf.Len())
+		buf.Write(encodeLogRecord(LOG_OP_PUT, key, entry))
+	}
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, &buf)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_RDWR, 0600)
+	if err != nil {
+		//the old file is still open but no longer named path, stop
+		//writing to it
+		s.closed = true
+		s.file.Close()
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	s.offsets = offsets
+	s.size = s.live
+	return nil
+}
+
+// Sync the log and close it.
+func (s *LogStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
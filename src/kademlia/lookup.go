@@ -0,0 +1,269 @@
+package kademlia
+
+// Contains the iterative lookup shared by IterativeFindNode and
+// IterativeFindValue. One goroutine owns a shortlist of every contact seen,
+// sorted by distance to the target, and keeps up to ALPHA queries in flight
+// to the closest contacts not queried yet. The lookup ends when each of the
+// MAX_BUCKET_SIZE closest contacts that didn't fail has replied, or, for a
+// value lookup, when a contact returns the value. A lookup for all values
+// keeps going to the end and groups the distinct values returned.
+//
+// A found value is cached on the closest contact that replied without it, as
+// in the Kademlia paper. The cached copy's TTL halves for every contact closer
+// to the key that replied, and never exceeds what the value has left.
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"time"
+)
+
+// Values found with less than this left are not cached.
+const MIN_CACHED_VALUE_TTL time.Duration = time.Minute
+
+//what a lookup is after
+const (
+	lookupNodes = iota
+	lookupValue
+	lookupValues
+)
+
+const (
+	lookupUnqueried = iota
+	lookupInFlight
+	lookupReplied
+	lookupFailed
+)
+
+type lookupEntry struct {
+	contact  Contact
+	distance ID
+	state    int
+	value    []byte
+}
+
+type lookupReply struct {
+	entry *lookupEntry
+	value []byte
+	ttl   time.Duration
+	nodes []Contact
+	err   error
+}
+
+type lookupResult struct {
+	//the closest contacts that replied, closest first
+	closest []Contact
+	//a value lookup's value, what it has left and the contacts that
+	//returned it
+	value    []byte
+	valueTTL time.Duration
+	holders  []Contact
+	//the closest contact that replied without the value and how many
+	//contacts closer to the key replied
+	cacheAt     *Contact
+	cacheCloser int
+	//every distinct value returned, for a lookup of all values
+	values []FoundValue
+}
+
+// A value returned by an iterative find and the nodes that returned it,
+// closest first.
+type FoundValue struct {
+	Value   []byte
+	Holders []Contact
+}
+
+type shortlist struct {
+	target  ID
+	entries []*lookupEntry
+	seen    map[ID]bool
+}
+
+// add a contact unless it was seen before, keeping entries sorted
+func (s *shortlist) add(c Contact) {
+	if s.seen[c.NodeID] {
+		return
+	}
+	s.seen[c.NodeID] = true
+	e := &lookupEntry{contact: c, distance: c.NodeID.Xor(s.target)}
+	i := sort.Search(len(s.entries), func(i int) bool {
+		return e.distance.Less(s.entries[i].distance)
+	})
+	s.entries = append(s.entries, nil)
+	copy(s.entries[i+1:], s.entries[i:])
+	s.entries[i] = e
+}
+
+func (s *shortlist) result() (result lookupResult) {
+	replied := 0
+	for _, e := range s.entries {
+		if e.state != lookupReplied {
+			continue
+		}
+		if len(result.closest) < MAX_BUCKET_SIZE {
+			result.closest = append(result.closest, e.contact)
+		}
+		if e.value != nil {
+			result.holders = append(result.holders, e.contact)
+			result.addValue(e.value, e.contact)
+		} else if result.cacheAt == nil {
+			c := e.contact
+			result.cacheAt = &c
+			result.cacheCloser = replied
+		}
+		replied++
+	}
+	return
+}
+
+func (r *lookupResult) addValue(value []byte, holder Contact) {
+	for i := range r.values {
+		if bytes.Equal(r.values[i].Value, value) {
+			r.values[i].Holders = append(r.values[i].Holders, holder)
+			return
+		}
+	}
+	r.values = append(r.values, FoundValue{value, []Contact{holder}})
+}
+
+//TTL of the cached copy of a value found with ttl left, halved once for the
+//caching contact and once for every replying contact closer to the key
+func (r lookupResult) cacheTTL() time.Duration {
+	halvings := r.cacheCloser + 1
+	if halvings > 62 {
+		return 0
+	}
+	return r.valueTTL >> uint(halvings)
+}
+
+func (k *Kademlia) lookup(ctx context.Context, target ID, mode int) (lookupResult, error) {
+	if err := ctx.Err(); err != nil {
+		return lookupResult{}, contextError(ctx, err)
+	}
+	k.touchBucket(target)
+	//cancels the queries still in flight when the lookup returns
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s := &shortlist{target: target, seen: map[ID]bool{k.NodeID: true}}
+	for _, c := range k.table.Closest(target, k.NodeID, MAX_BUCKET_SIZE) {
+		s.add(c)
+	}
+
+	//room for every query in flight, so none blocks after we return
+	replies := make(chan lookupReply, ALPHA)
+	inFlight := 0
+	var value []byte
+	var valueTTL time.Duration
+	for mode != lookupValue || value == nil {
+		//query the closest unqueried contacts among the MAX_BUCKET_SIZE
+		//closest that didn't fail, we are done once all of those replied
+		active, done := 0, true
+		for _, e := range s.entries {
+			if active == MAX_BUCKET_SIZE {
+				break
+			}
+			if e.state == lookupFailed {
+				continue
+			}
+			active++
+			if e.state == lookupUnqueried && inFlight < ALPHA {
+				e.state = lookupInFlight
+				inFlight++
+				go k.lookupQuery(ctx, e, target, mode, replies)
+			}
+			if e.state == lookupInFlight {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+
+		select {
+		case reply := <-replies:
+			inFlight--
+			if reply.err != nil {
+				reply.entry.state = lookupFailed
+				continue
+			}
+			reply.entry.state = lookupReplied
+			if reply.value != nil {
+				reply.entry.value = reply.value
+				value, valueTTL = reply.value, reply.ttl
+			}
+			for _, c := range reply.nodes {
+				s.add(c)
+			}
+		case <-ctx.Done():
+			return s.result(), contextError(ctx, ctx.Err())
+		}
+	}
+	result := s.result()
+	result.value, result.valueTTL = value, valueTTL
+	return result, nil
+}
+
+func (k *Kademlia) lookupQuery(ctx context.Context, e *lookupEntry, target ID, mode int, replies chan lookupReply) {
+	contact := e.contact
+	reply := lookupReply{entry: e}
+	if mode != lookupNodes {
+		var res FindValueResult
+		res, reply.err = k.findValue(ctx, &contact, target)
+		reply.value, reply.ttl, reply.nodes = res.Value, res.TTL, res.Nodes
+	} else {
+		reply.nodes, reply.err = k.FindNode(ctx, &contact, target)
+	}
+	replies <- reply
+}
+
+// Look up the closest nodes to id, closest first. When ctx ends first the
+// nodes found so far are returned with the context's error.
+func (k *Kademlia) IterativeFindNode(ctx context.Context, id ID) ([]Contact, error) {
+	result, err := k.lookup(ctx, id, lookupNodes)
+	return result.closest, err
+}
+
+// Look up the value of key. On success the contacts are the nodes that
+// returned the value, otherwise they are the closest nodes seen and the error
+// is ErrNotFound, or the context's error when ctx ended first. A found value
+// is cached on the closest node that didn't have it.
+func (k *Kademlia) IterativeFindValue(ctx context.Context, key ID) ([]byte, []Contact, error) {
+	result, err := k.lookup(ctx, key, lookupValue)
+	if err != nil {
+		return nil, result.closest, err
+	}
+	if result.value == nil {
+		return nil, result.closest, ErrNotFound
+	}
+	if ttl := result.cacheTTL(); result.cacheAt != nil && ttl >= MIN_CACHED_VALUE_TTL {
+		k.Store(ctx, result.cacheAt, key, result.value, ttl)
+	}
+	return result.value, result.holders, nil
+}
+
+// Look up key on each of the MAX_BUCKET_SIZE closest nodes instead of
+// stopping at the first value, so a wrong value returned by a stale or
+// malicious node doesn't hide the right one. The distinct values are
+// returned with the nodes that returned each, the most returned first. The
+// contacts and errors are the same as for IterativeFindValue, and nothing is
+// cached since which value is right isn't known.
+func (k *Kademlia) IterativeFindValues(ctx context.Context, key ID) ([]FoundValue, []Contact, error) {
+	result, err := k.lookup(ctx, key, lookupValues)
+	if err != nil {
+		return nil, result.closest, err
+	}
+	if len(result.values) == 0 {
+		return nil, result.closest, ErrNotFound
+	}
+	return sortFoundValues(result.values), result.closest, nil
+}
+
+//most returned values first
+func sortFoundValues(values []FoundValue) []FoundValue {
+	sort.SliceStable(values, func(i, j int) bool {
+		return len(values[i].Holders) > len(values[j].Holders)
+	})
+	return values
+}
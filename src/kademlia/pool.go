@@ -0,0 +1,161 @@
+package kademlia
+
+// Contains the pool of RPC clients kept open to peers, so that a lookup
+// reuses connections instead of dialing every peer for every query.
+
+import (
+	"context"
+	"errors"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_PEER_CONNECTIONS               = 4
+	IDLE_CONN_TIMEOUT    time.Duration = 90 * time.Second
+)
+
+type pooledClient struct {
+	client   *rpc.Client
+	lastUsed time.Time
+}
+
+// Connections to one peer, slots holds a token for every connection in use
+// so at most MAX_PEER_CONNECTIONS are open at once.
+type peerConns struct {
+	slots chan struct{}
+	idle  []pooledClient
+}
+
+type clientPool struct {
+	mutex  sync.Mutex
+	peers  map[string]*peerConns
+	closed bool
+	done   chan struct{}
+}
+
+func newClientPool() *clientPool {
+	p := new(clientPool)
+	p.peers = make(map[string]*peerConns)
+	p.done = make(chan struct{})
+	go p.reapIdle()
+	return p
+}
+
+func (p *clientPool) peer(address string) *peerConns {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pc, ok := p.peers[address]
+	if !ok {
+		pc = &peerConns{slots: make(chan struct{}, MAX_PEER_CONNECTIONS)}
+		p.peers[address] = pc
+	}
+	return pc
+}
+
+//get a client for address, waiting for a free slot when the peer already has
+//MAX_PEER_CONNECTIONS in use. Every client got must be given back with put.
+func (p *clientPool) get(ctx context.Context, address string, path string) (*rpc.Client, error) {
+	var pc *peerConns
+	for {
+		pc = p.peer(address)
+		select {
+		case pc.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		p.mutex.Lock()
+		//reapIdle may have dropped the peer before we took the slot
+		if p.peers[address] == pc {
+			break
+		}
+		p.mutex.Unlock()
+		<-pc.slots
+	}
+
+	for len(pc.idle) > 0 {
+		last := pc.idle[len(pc.idle)-1]
+		pc.idle = pc.idle[:len(pc.idle)-1]
+		if time.Since(last.lastUsed) < IDLE_CONN_TIMEOUT {
+			p.mutex.Unlock()
+			return last.client, nil
+		}
+		last.client.Close()
+	}
+	p.mutex.Unlock()
+
+	client, err := dialHTTPPath(ctx, address, path)
+	if err != nil {
+		<-pc.slots
+		return nil, err
+	}
+	return client, nil
+}
+
+//give back a client got from the pool, err is the result of the call made
+//with it. Clients whose connection may be broken are closed, not reused.
+func (p *clientPool) put(address string, client *rpc.Client, err error) {
+	pc := p.peer(address)
+	p.mutex.Lock()
+	if healthy(err) && !p.closed {
+		pc.idle = append(pc.idle, pooledClient{client, time.Now()})
+	} else {
+		client.Close()
+	}
+	p.mutex.Unlock()
+	<-pc.slots
+}
+
+//a call that failed on the server side leaves the connection usable, any
+//other failure (shutdown, timeout, decode error) may not
+func healthy(err error) bool {
+	var serverErr rpc.ServerError
+	return err == nil || errors.As(err, &serverErr)
+}
+
+//close the idle connections, the ones in use are closed when given back
+func (p *clientPool) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.done)
+	for _, pc := range p.peers {
+		for _, c := range pc.idle {
+			c.client.Close()
+		}
+		pc.idle = nil
+	}
+}
+
+//drop the connections nobody used for IDLE_CONN_TIMEOUT
+func (p *clientPool) reapIdle() {
+	ticker := time.NewTicker(IDLE_CONN_TIMEOUT / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+		p.mutex.Lock()
+		for address, pc := range p.peers {
+			live := pc.idle[:0]
+			for _, c := range pc.idle {
+				if time.Since(c.lastUsed) < IDLE_CONN_TIMEOUT {
+					live = append(live, c)
+				} else {
+					c.client.Close()
+				}
+			}
+			pc.idle = live
+			if len(pc.idle) == 0 && len(pc.slots) == 0 {
+				delete(p.peers, address)
+			}
+		}
+		p.mutex.Unlock()
+	}
+}
@@ -0,0 +1,309 @@
+package kademlia
+
+// Contains the limits on what other nodes can store here. A value may be at
+// most MaxValueSize bytes, each sender, told apart both by NodeID and by the
+// IP its requests come from, may hold at most MaxKeysPerSender keys, and all
+// values together may take at most MaxStoreBytes. When they would take more,
+// the values expiring first are evicted, but only those expiring before the
+// new one. A refused store gets a StoreRefusedError back so the sender can
+// try other nodes.
+
+import (
+	"container/heap"
+	"encoding/gob"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Defaults of a node's Config.
+const (
+	MAX_VALUE_SIZE            = 64 << 10
+	MAX_STORE_BYTES     int64 = 64 << 20
+	MAX_KEYS_PER_SENDER       = 4096
+)
+
+// Why a node refused to store a value.
+type StoreRefusal int
+
+const (
+	REFUSED_VALUE_TOO_LARGE StoreRefusal = iota + 1
+	REFUSED_STORE_FULL
+	REFUSED_SENDER_QUOTA
+)
+
+var ErrStoreRefused = errors.New("store refused")
+
+// The StoreResult.Err of a refused store, it matches ErrStoreRefused.
+type StoreRefusedError struct {
+	Reason StoreRefusal
+}
+
+func (e *StoreRefusedError) Error() string {
+	switch e.Reason {
+	case REFUSED_VALUE_TOO_LARGE:
+		return "store refused: value too large"
+	case REFUSED_STORE_FULL:
+		return "store refused: node is full"
+	case REFUSED_SENDER_QUOTA:
+		return "store refused: sender holds too many keys"
+	}
+	return ErrStoreRefused.Error()
+}
+
+func (e *StoreRefusedError) Is(target error) bool {
+	return target == ErrStoreRefused
+}
+
+func init() {
+	//StoreResult.Err crosses the wire as an interface
+	gob.Register(&StoreRefusedError{})
+}
+
+//what each stored value takes and who stored it, the sender is unknown for
+//values stored locally or found in the store at startup
+type quotaEntry struct {
+	size      int64
+	expires   time.Time
+	hasSender bool
+	senderID  ID
+	senderIP  string
+	key       ID
+	index     int
+}
+
+//the quota's entries as a heap, the one expiring first at the root
+type expiryHeap []*quotaEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*quotaEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+//positions in an expiryHeap ordered by the expiry of the entries there, to
+//walk the heap in expiry order without taking it apart
+type expiryWalk struct {
+	entries   expiryHeap
+	positions []int
+}
+
+func (w *expiryWalk) Len() int { return len(w.positions) }
+
+func (w *expiryWalk) Less(i, j int) bool {
+	return w.entries[w.positions[i]].expires.Before(w.entries[w.positions[j]].expires)
+}
+
+func (w *expiryWalk) Swap(i, j int) {
+	w.positions[i], w.positions[j] = w.positions[j], w.positions[i]
+}
+
+func (w *expiryWalk) Push(x interface{}) { w.positions = append(w.positions, x.(int)) }
+
+func (w *expiryWalk) Pop() interface{} {
+	p := w.positions[len(w.positions)-1]
+	w.positions = w.positions[:len(w.positions)-1]
+	return p
+}
+
+type storeQuota struct {
+	mutex    sync.Mutex
+	bytes    int64
+	entries  map[ID]*quotaEntry
+	byExpiry expiryHeap
+	keysByID map[ID]int
+	keysByIP map[string]int
+}
+
+//account for the values already in store
+func newStoreQuota(store Store) *storeQuota {
+	q := &storeQuota{
+		entries:  make(map[ID]*quotaEntry),
+		keysByID: make(map[ID]int),
+		keysByIP: make(map[string]int),
+	}
+	store.Iterate(func(key ID, entry StoreEntry) bool {
+		q.add(key, quotaEntry{size: int64(len(entry.Value)), expires: entry.Expires})
+		return true
+	})
+	return q
+}
+
+func (q *storeQuota) add(key ID, e quotaEntry) {
+	q.remove(key)
+	e.key = key
+	q.entries[key] = &e
+	heap.Push(&q.byExpiry, &e)
+	q.bytes += e.size
+	if e.hasSender {
+		q.keysByID[e.senderID]++
+		q.keysByIP[e.senderIP]++
+	}
+}
+
+func (q *storeQuota) remove(key ID) {
+	e, ok := q.entries[key]
+	if !ok {
+		return
+	}
+	delete(q.entries, key)
+	heap.Remove(&q.byExpiry, e.index)
+	q.bytes -= e.size
+	if e.hasSender {
+		if q.keysByID[e.senderID]--; q.keysByID[e.senderID] == 0 {
+			delete(q.keysByID, e.senderID)
+		}
+		if q.keysByIP[e.senderIP]--; q.keysByIP[e.senderIP] == 0 {
+			delete(q.keysByIP, e.senderIP)
+		}
+	}
+}
+
+//who a value is stored for, the NodeID its sender claims and the IP the
+//request came from
+type storeSender struct {
+	nodeID ID
+	ip     string
+}
+
+//the sender of a request, counted by the IP the request came from rather
+//than the Host it claims
+func (in *inbound) storeSender(sender Contact) *storeSender {
+	ip := in.remoteIP
+	if ip == nil {
+		ip = sender.Host
+	}
+	return &storeSender{sender.NodeID, ip.String()}
+}
+
+//whether storing key for sender would take it past limit keys
+func (q *storeQuota) overSenderLimit(key ID, sender *storeSender, limit int) bool {
+	if sender == nil || limit <= 0 {
+		return false
+	}
+	old, exists := q.entries[key]
+	if (!exists || !old.hasSender || old.senderID != sender.nodeID) && q.keysByID[sender.nodeID] >= limit {
+		return true
+	}
+	if (!exists || !old.hasSender || old.senderIP != sender.ip) && q.keysByIP[sender.ip] >= limit {
+		return true
+	}
+	return false
+}
+
+//the values to evict to free need bytes, the ones expiring first but before
+//expires, not counting key. ok is false when they can't free enough. Only
+//the entries expiring before the victims are looked at.
+func (q *storeQuota) victims(key ID, need int64, expires time.Time) (keys []ID, ok bool) {
+	if len(q.byExpiry) == 0 {
+		return nil, false
+	}
+	walk := &expiryWalk{entries: q.byExpiry, positions: []int{0}}
+	var freed int64
+	for freed < need && walk.Len() > 0 {
+		i := heap.Pop(walk).(int)
+		e := q.byExpiry[i]
+		if !e.expires.Before(expires) {
+			break
+		}
+		if e.key != key {
+			keys = append(keys, e.key)
+			freed += e.size
+		}
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child < len(q.byExpiry) {
+				heap.Push(walk, child)
+			}
+		}
+	}
+	return keys, freed >= need
+}
+
+//store value under key for sender, nil when stored locally, within the
+//node's limits
+func (k *Kademlia) storeValueFrom(sender *storeSender, key ID, value []byte, ttl time.Duration) error {
+	if max := k.config.MaxValueSize; max > 0 && len(value) > max {
+		return &StoreRefusedError{REFUSED_VALUE_TOO_LARGE}
+	}
+	now := k.config.Clock.Now()
+	entry := StoreEntry{value, now.Add(k.valueTTL(ttl)), now}
+
+	q := k.quota
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.overSenderLimit(key, sender, k.config.MaxKeysPerSender) {
+		return &StoreRefusedError{REFUSED_SENDER_QUOTA}
+	}
+	if max := k.config.MaxStoreBytes; max > 0 {
+		need := q.bytes + int64(len(value)) - max
+		if old, ok := q.entries[key]; ok {
+			need -= old.size
+		}
+		if need > 0 {
+			victims, ok := q.victims(key, need, entry.Expires)
+			if !ok {
+				return &StoreRefusedError{REFUSED_STORE_FULL}
+			}
+			for _, victim := range victims {
+				if err := k.values.Delete(victim); err != nil {
+					return err
+				}
+				q.remove(victim)
+			}
+		}
+	}
+
+	if err := k.values.Put(key, entry); err != nil {
+		return err
+	}
+	e := quotaEntry{size: int64(len(value)), expires: entry.Expires}
+	if sender != nil {
+		e.hasSender, e.senderID, e.senderIP = true, sender.nodeID, sender.ip
+	}
+	q.add(key, e)
+	return nil
+}
+
+//delete the value stored under key if it has expired by now, it may have
+//been stored again since it was seen expired
+func (k *Kademlia) deleteExpiredValue(key ID, now time.Time) error {
+	k.quota.mutex.Lock()
+	defer k.quota.mutex.Unlock()
+	stored, ok, err := k.values.Get(key)
+	if err != nil || !ok || now.Before(stored.Expires) {
+		return err
+	}
+	if err := k.values.Delete(key); err != nil {
+		return err
+	}
+	k.quota.remove(key)
+	return nil
+}
+
+//note that the value under key was replicated at now, unless it is gone
+func (k *Kademlia) markReplicated(key ID, now time.Time) error {
+	k.quota.mutex.Lock()
+	defer k.quota.mutex.Unlock()
+	stored, ok, err := k.values.Get(key)
+	if err != nil || !ok {
+		return err
+	}
+	stored.Stored = now
+	return k.values.Put(key, stored)
+}
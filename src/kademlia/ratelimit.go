@@ -0,0 +1,336 @@
+package kademlia
+
+// Contains the rate limits on inbound RPCs. Every request is charged to a
+// token bucket for the IP it came from and one for the NodeID it comes from;
+// a request either bucket can't pay for is answered with ErrRateLimited
+// before its method runs, so it never updates our contacts or makes us ping
+// anyone. Batched requests cost one token per key. A NodeID is only charged
+// once the request is known to come from it, by its signature when verifying
+// NodeIDs and by the Host it claims otherwise, so nobody can drain the bucket
+// of another node.
+//
+// The limits are checked by the ServerCodec of each connection, the only
+// place that sees both the connection and the decoded request. A node
+// verifying NodeIDs checks the signature of the requests it lets through
+// there too, answering ErrBadSignature or ErrStaleMessage to the ones it
+// doesn't take, and a node with an identity signs its responses there.
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of a node's Config, in requests per second and requests.
+const (
+	IP_REQUEST_RATE    = 200
+	IP_REQUEST_BURST   = 1000
+	NODE_REQUEST_RATE  = 50
+	NODE_REQUEST_BURST = 250
+)
+
+var ErrRateLimited = errors.New("rate limited")
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//token buckets by key holding up to burst tokens and refilled at rate
+//tokens per second, a rate of 0 means no limit
+type rateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64
+	burst   float64
+	clock   Clock
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rate float64, burst int, clock Clock) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), clock: clock, buckets: make(map[string]*tokenBucket)}
+}
+
+//refill b up to now
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+}
+
+//take n tokens from key's bucket if it has them
+func (l *rateLimiter) allow(key string, n float64) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.clock.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{l.burst, now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+//forget the buckets that refilled, they are the same as new ones
+func (l *rateLimiter) prune() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.clock.Now()
+	for key, b := range l.buckets {
+		if l.refill(b, now); b.tokens == l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (k *Kademlia) pruneRateLimiters() {
+	k.ipLimiter.prune()
+	k.nodeLimiter.prune()
+}
+
+// Counts of the RPCs a node received, by method name.
+type RPCStats struct {
+	Served  map[string]uint64
+	Limited map[string]uint64
+}
+
+type rpcCounters struct {
+	mutex   sync.Mutex
+	served  map[string]uint64
+	limited map[string]uint64
+}
+
+func newRPCCounters() *rpcCounters {
+	return &rpcCounters{served: make(map[string]uint64), limited: make(map[string]uint64)}
+}
+
+func (c *rpcCounters) count(method string, limited bool) {
+	c.mutex.Lock()
+	if limited {
+		c.limited[method]++
+	} else {
+		c.served[method]++
+	}
+	c.mutex.Unlock()
+}
+
+// Counts of the RPCs received since the node started.
+func (k *Kademlia) RPCStats() RPCStats {
+	c := k.counters
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := RPCStats{make(map[string]uint64), make(map[string]uint64)}
+	for method, n := range c.served {
+		stats.Served[method] = n
+	}
+	for method, n := range c.limited {
+		stats.Limited[method] = n
+	}
+	return stats
+}
+
+//who a request claims to come from and how many tokens it costs
+func requestSender(body interface{}) (sender Contact, cost int) {
+	switch req := body.(type) {
+	case *PingMessage:
+		return req.Sender, 1
+	case *StoreRequest:
+		return req.Sender, 1
+	case *FindNodeRequest:
+		return req.Sender, 1
+	case *FindValueRequest:
+		return req.Sender, 1
+	case *GetVDORequest:
+		return req.Sender, 1
+	case *StoreBatchRequest:
+		return req.Sender, len(req.Items)
+	case *FindNodeBatchRequest:
+		return req.Sender, len(req.NodeIDs)
+	case *FindValueBatchRequest:
+		return req.Sender, len(req.Keys)
+	}
+	return Contact{}, 1
+}
+
+//the gob ServerCodec of net/rpc, checking the rate limits of each request
+//once it is decoded
+type limitedServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+
+	k      *Kademlia
+	ip     string
+	method string
+	seq    uint64
+
+	//who to sign the response to each request for, by sequence number,
+	//responses are written while the next requests are read
+	mutex   sync.Mutex
+	replies map[uint64]reply
+}
+
+type reply struct {
+	method string
+	to     ID
+	nonce  ID
+}
+
+func (k *Kademlia) newLimitedServerCodec(conn net.Conn) *limitedServerCodec {
+	ip := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	buf := bufio.NewWriter(conn)
+	return &limitedServerCodec{
+		rwc:     conn,
+		dec:     gob.NewDecoder(conn),
+		enc:     gob.NewEncoder(buf),
+		encBuf:  buf,
+		k:       k,
+		replies: make(map[uint64]reply),
+		ip:      ip,
+	}
+}
+
+func (c *limitedServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	c.method = strings.TrimPrefix(r.ServiceMethod, "KademliaCore.")
+	c.seq = r.Seq
+	return nil
+}
+
+func (c *limitedServerCodec) ReadRequestBody(body interface{}) error {
+	if err := c.dec.Decode(body); err != nil || body == nil {
+		return err
+	}
+	sender, cost := requestSender(body)
+	if cost < 1 {
+		cost = 1
+	}
+	//a request refused for its NodeID still costs its IP tokens, so a
+	//flood can't get through by changing NodeIDs
+	k := c.k
+	limited := !k.ipLimiter.allow(c.ip, float64(cost))
+	msg, signed := body.(signable)
+	var verifyErr error
+	if !limited && signed && k.config.VerifyNodeIDs {
+		verifyErr = k.verifyRequest(c.method, msg, sender.NodeID)
+	}
+	fromSender := k.config.VerifyNodeIDs || sender.Host.Equal(net.ParseIP(c.ip))
+	if !limited && verifyErr == nil && fromSender {
+		limited = !k.nodeLimiter.allow(string(sender.NodeID[:]), float64(cost))
+	}
+	k.counters.count(c.method, limited)
+	if limited {
+		return ErrRateLimited
+	}
+	if verifyErr != nil {
+		return verifyErr
+	}
+	if signed {
+		c.mutex.Lock()
+		c.replies[c.seq] = reply{c.method, sender.NodeID, msg.signed().Nonce}
+		c.mutex.Unlock()
+	}
+	if in, ok := body.(interface{ setRemoteIP(net.IP) }); ok {
+		in.setRemoteIP(net.ParseIP(c.ip))
+	}
+	return nil
+}
+
+func (c *limitedServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	c.mutex.Lock()
+	reply, ok := c.replies[r.Seq]
+	delete(c.replies, r.Seq)
+	c.mutex.Unlock()
+	if msg, signable := body.(signable); ok && signable && r.Error == "" && c.k.identity != nil {
+		msg.signed().Nonce = reply.nonce
+		if err = c.k.identity.sign(reply.method+"Reply", msg, reply.to, c.k.config.Clock.Now()); err != nil {
+			return
+		}
+	}
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			log.Println("rpc: gob error encoding response:", err)
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			log.Println("rpc: gob error encoding body:", err)
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *limitedServerCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+//serves net/rpc over HTTP CONNECT like rpc.Server.ServeHTTP, with each
+//connection's requests rate limited
+type rpcHandler struct {
+	server *rpc.Server
+	k      *Kademlia
+}
+
+func (h rpcHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Print("rpc hijacking ", req.RemoteAddr, ": ", err.Error())
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 "+rpcConnected+"\n\n")
+	h.server.ServeCodec(h.k.newLimitedServerCodec(conn))
+}
+
+//an error a peer answered with, as ErrRateLimited when it limited us and
+//ErrBadSignature or ErrStaleMessage when it didn't take our signature
+func serverError(err error) error {
+	var serverErr rpc.ServerError
+	if !errors.As(err, &serverErr) {
+		return err
+	}
+	for _, known := range []error{ErrRateLimited, ErrBadSignature, ErrStaleMessage} {
+		if string(serverErr) == known.Error() {
+			return fmt.Errorf("%w: %w", known, err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package kademlia
+
+// Contains the refreshing of buckets. Buckets otherwise only change when
+// other nodes contact us, so the buckets of a quiet node go stale; a lookup
+// of an ID in a bucket's range fills it with the nodes currently there.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+//note that a lookup of id refreshes id's bucket
+func (k *Kademlia) touchBucket(id ID) {
+	bucketIndex := k.bucketIndex(id)
+	if bucketIndex < 0 {
+		return
+	}
+	k.lookupMutex.Lock()
+	k.bucketLookups[bucketIndex] = k.config.Clock.Now()
+	k.lookupMutex.Unlock()
+}
+
+//a random ID that belongs in bucket bucketIndex: it shares a prefix of
+//IDBytes*8 - bucketIndex bits with our ID and differs in the next bit
+func (k *Kademlia) randomIDInBucket(bucketIndex int) ID {
+	prefixLength := IDBytes*8 - bucketIndex
+	if bucketIndex == IDBytes*8-1 {
+		//the last bucket also takes the IDs differing in the first bit
+		prefixLength = rand.Intn(2)
+	}
+	id := NewRandomID()
+	for bit := 0; bit <= prefixLength && bit < IDBytes*8; bit++ {
+		mask := byte(0x80) >> uint(bit%8)
+		own := k.NodeID[bit/8] & mask
+		if bit == prefixLength {
+			own ^= mask
+		}
+		id[bit/8] = id[bit/8]&^mask | own
+	}
+	return id
+}
+
+//the buckets that have contacts and were not looked up in for RefreshInterval
+func (k *Kademlia) staleBuckets() []int {
+	now := k.config.Clock.Now()
+	var stale []int
+	k.lookupMutex.Lock()
+	defer k.lookupMutex.Unlock()
+	for _, i := range k.table.nonEmptyBuckets() {
+		if now.Sub(k.bucketLookups[i]) >= k.config.RefreshInterval {
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
+
+// Look up a random ID in every bucket that has contacts and was not looked up
+// in for RefreshInterval, one bucket at a time. Run it after bootstrapping so
+// the routing table doesn't hold only the bootstrap node.
+func (k *Kademlia) RefreshBuckets(ctx context.Context) error {
+	for _, bucketIndex := range k.staleBuckets() {
+		lookupCtx, cancel := context.WithTimeout(ctx, LOOKUP_TIMEOUT)
+		k.IterativeFindNode(lookupCtx, k.randomIDInBucket(bucketIndex))
+		cancel()
+		if ctx.Err() != nil {
+			return contextError(ctx, ctx.Err())
+		}
+	}
+	return nil
+}
+
+//refresh the stale buckets until the node is closed
+func (k *Kademlia) refreshStaleBuckets() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-k.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	k.RefreshBuckets(ctx)
+}
+
+// Join the network through seeds, host:port addresses of nodes already in it.
+// After pinging the seeds the node looks itself up and refreshes every bucket
+// farther than its closest neighbour, as in the Kademlia paper. Seeds that
+// don't answer are skipped, Join fails only when none does.
+func (k *Kademlia) Join(ctx context.Context, seeds []string) error {
+	if len(seeds) == 0 {
+		return errors.New("no seeds to join through")
+	}
+	var errs []error
+	for _, seed := range seeds {
+		host, port, err := ResolveAddr(ctx, seed)
+		if err == nil {
+			_, err = k.Ping(ctx, host, port)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", seed, err))
+		}
+	}
+	if len(errs) == len(seeds) {
+		return errors.Join(errs...)
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, LOOKUP_TIMEOUT)
+	k.IterativeFindNode(lookupCtx, k.NodeID)
+	cancel()
+	if ctx.Err() != nil {
+		return contextError(ctx, ctx.Err())
+	}
+
+	closest := k.FindClosestContacts(k.NodeID, k.NodeID)
+	if len(closest) == 0 {
+		return nil
+	}
+	for bucketIndex := k.bucketIndex(closest[0].NodeID) + 1; bucketIndex < IDBytes*8; bucketIndex++ {
+		lookupCtx, cancel := context.WithTimeout(ctx, LOOKUP_TIMEOUT)
+		k.IterativeFindNode(lookupCtx, k.randomIDInBucket(bucketIndex))
+		cancel()
+		if ctx.Err() != nil {
+			return contextError(ctx, ctx.Err())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package kademlia
+
+// Contains the liveness checks behind the routing table's replacement caches,
+// from the Kademlia paper. Contacts seen while their bucket is full wait in a
+// per-bucket cache and take the place of bucket contacts that stop answering.
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	REPLACEMENT_CACHE_SIZE = MAX_BUCKET_SIZE
+	MAX_CONTACT_FAILURES   = 5
+)
+
+//ping the least recently seen contact of a full bucket, it goes to the back
+//of the bucket if it answers and is replaced otherwise
+func (k *Kademlia) checkLRU(lru Contact) {
+	ctx, cancel := context.WithTimeout(context.Background(), RPC_TIMEOUT)
+	defer cancel()
+	//a dial failure or timeout means the peer is unresponsive, so is
+	//another node answering at its address
+	sender, err := k.ping(ctx, lru.Host, lru.Port)
+	k.table.CheckedLRU(lru, err == nil && sender.NodeID.Equals(lru.NodeID))
+}
+
+//note that an RPC to contact failed. Errors returned by the contact and our
+//own cancellations don't count.
+func (k *Kademlia) contactFailed(contact Contact, err error) {
+	if healthy(err) || errors.Is(err, context.Canceled) {
+		return
+	}
+	k.table.Failed(contact)
+}
@@ -0,0 +1,74 @@
+package kademlia
+
+// Contains the republishing of values from the Kademlia paper. Nodes holding
+// a value copy it to the current closest nodes to its key, so it survives
+// churn, and the node that published it stores it again until its lifetime
+// is over. Neither extends a value's expiry, so it disappears once its
+// publisher stops republishing it.
+
+import (
+	"context"
+	"time"
+)
+
+//remember a value this node published for ttl
+func (k *Kademlia) publish(key ID, value []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = k.config.DefaultValueTTL
+	}
+	k.published.Put(key, StoreEntry{Value: value, Expires: k.config.Clock.Now().Add(ttl)})
+}
+
+type keyValue struct {
+	key   ID
+	value []byte
+	ttl   time.Duration
+}
+
+//store each value on the closest nodes to its key for what is left of its
+//lifetime, one lookup at a time
+func (k *Kademlia) storeAll(values []keyValue) {
+	for _, kv := range values {
+		ctx, cancel := context.WithTimeout(context.Background(), LOOKUP_TIMEOUT)
+		k.storeClosest(ctx, kv.key, kv.value, kv.ttl)
+		cancel()
+		select {
+		case <-k.done:
+			return
+		default:
+		}
+	}
+}
+
+//copy the values this node holds to the closest nodes to their keys. Values
+//stored here within the last ReplicateInterval are skipped, whoever stored
+//them has just replicated them.
+func (k *Kademlia) replicateValues() {
+	now := k.config.Clock.Now()
+	var values []keyValue
+	k.values.Iterate(func(key ID, stored StoreEntry) bool {
+		if !now.Before(stored.Expires) || now.Sub(stored.Stored) < k.config.ReplicateInterval {
+			return true
+		}
+		values = append(values, keyValue{key, stored.Value, stored.Expires.Sub(now)})
+		k.markReplicated(key, now)
+		return true
+	})
+	k.storeAll(values)
+}
+
+//store again the values this node published, forgetting the ones whose
+//lifetime is over
+func (k *Kademlia) republishValues() {
+	now := k.config.Clock.Now()
+	var values []keyValue
+	k.published.Iterate(func(key ID, published StoreEntry) bool {
+		if !now.Before(published.Expires) {
+			k.published.Delete(key)
+			return true
+		}
+		values = append(values, keyValue{key, published.Value, published.Expires.Sub(now)})
+		return true
+	})
+	k.storeAll(values)
+}
@@ -0,0 +1,237 @@
+package kademlia
+
+// Contains the routing table: a node's k-buckets and their replacement
+// caches. The table has its own lock and every method holds it for the whole
+// operation, so concurrent RPCs can't add a contact twice or change a bucket
+// between a lookup and an update.
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+)
+
+type RoutingTable struct {
+	self  ID
+	mutex sync.RWMutex
+
+	buckets [IDBytes * 8]*list.List
+	//candidates for full buckets, most recently seen last
+	replacements [IDBytes * 8]*list.List
+	//whether the least recently seen contact of a bucket is being pinged
+	checkingLRU [IDBytes * 8]bool
+	//RPCs failed in a row per contact
+	failures map[ID]int
+}
+
+func NewRoutingTable(self ID) *RoutingTable {
+	rt := new(RoutingTable)
+	rt.self = self
+	for i := 0; i < len(rt.buckets); i++ {
+		rt.buckets[i] = list.New()
+		rt.replacements[i] = list.New()
+	}
+	rt.failures = make(map[ID]int)
+	return rt
+}
+
+//index of the bucket nodeid belongs in, -1 for our own ID
+func (rt *RoutingTable) bucketIndex(nodeid ID) int {
+	prefixLength := rt.self.Xor(nodeid).PrefixLen()
+	if prefixLength == 160 {
+		return -1
+	}
+	bucketIndex := (IDBytes * 8) - prefixLength
+
+	//if ping yourself, then the distance would be 160, and it will ran out of index
+	if bucketIndex > (IDBytes*8 - 1) {
+		bucketIndex = (IDBytes*8 - 1)
+	}
+	return bucketIndex
+}
+
+func findInList(l *list.List, nodeId ID) *list.Element {
+	for e := l.Front(); e != nil; e = e.Next() {
+		if e.Value.(Contact).NodeID.Equals(nodeId) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Move contact to the back of its bucket, or add it there if the bucket has
+// room. When the bucket is full the contact is kept as a replacement and, if
+// no check is running yet, the bucket's least recently seen contact is
+// returned with check set; the caller pings it and reports with CheckedLRU.
+func (rt *RoutingTable) Update(contact Contact) (lru Contact, check bool) {
+	bucketIndex := rt.bucketIndex(contact.NodeID)
+	if bucketIndex < 0 {
+		return
+	}
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	delete(rt.failures, contact.NodeID)
+	bucket := rt.buckets[bucketIndex]
+
+	//if contact has already existed, then move contact to the end of bucket
+	if res := findInList(bucket, contact.NodeID); res != nil {
+		res.Value = contact
+		bucket.MoveToBack(res)
+		return
+	}
+	//check if bucket is full, if not, add contact to the end of bucket
+	if bucket.Len() < MAX_BUCKET_SIZE {
+		bucket.PushBack(contact)
+		rt.removeReplacement(bucketIndex, contact.NodeID)
+		return
+	}
+
+	//if bucket is full, keep the contact as a replacement
+	rt.addReplacement(bucketIndex, contact)
+	if rt.checkingLRU[bucketIndex] {
+		return
+	}
+	rt.checkingLRU[bucketIndex] = true
+	return bucket.Front().Value.(Contact), true
+}
+
+// Report whether the contact returned by Update answered. It goes to the back
+// of its bucket if it did and is replaced otherwise.
+func (rt *RoutingTable) CheckedLRU(lru Contact, alive bool) {
+	bucketIndex := rt.bucketIndex(lru.NodeID)
+	if bucketIndex < 0 {
+		return
+	}
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	rt.checkingLRU[bucketIndex] = false
+	e := findInList(rt.buckets[bucketIndex], lru.NodeID)
+	if e == nil {
+		return
+	}
+	if alive {
+		rt.buckets[bucketIndex].MoveToBack(e)
+	} else {
+		rt.replaceContact(bucketIndex, e)
+	}
+}
+
+// Note that an RPC to contact failed. After MAX_CONTACT_FAILURES failures in
+// a row the contact is replaced, if there is a replacement for it.
+func (rt *RoutingTable) Failed(contact Contact) {
+	bucketIndex := rt.bucketIndex(contact.NodeID)
+	if bucketIndex < 0 {
+		return
+	}
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	rt.failures[contact.NodeID]++
+	if rt.failures[contact.NodeID] < MAX_CONTACT_FAILURES || rt.replacements[bucketIndex].Len() == 0 {
+		return
+	}
+	delete(rt.failures, contact.NodeID)
+	if e := findInList(rt.buckets[bucketIndex], contact.NodeID); e != nil {
+		rt.replaceContact(bucketIndex, e)
+	}
+}
+
+// Remove a contact, its place goes to the most recently seen replacement.
+// Returns whether the contact was in the table.
+func (rt *RoutingTable) Remove(nodeId ID) bool {
+	bucketIndex := rt.bucketIndex(nodeId)
+	if bucketIndex < 0 {
+		return false
+	}
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	delete(rt.failures, nodeId)
+	rt.removeReplacement(bucketIndex, nodeId)
+	e := findInList(rt.buckets[bucketIndex], nodeId)
+	if e == nil {
+		return false
+	}
+	rt.replaceContact(bucketIndex, e)
+	return true
+}
+
+func (rt *RoutingTable) Find(nodeId ID) (Contact, bool) {
+	bucketIndex := rt.bucketIndex(nodeId)
+	if bucketIndex < 0 {
+		return Contact{}, false
+	}
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	if e := findInList(rt.buckets[bucketIndex], nodeId); e != nil {
+		return e.Value.(Contact), true
+	}
+	return Contact{}, false
+}
+
+// The count contacts closest to target, closest first, leaving out exclude.
+func (rt *RoutingTable) Closest(target ID, exclude ID, count int) []Contact {
+	rt.mutex.RLock()
+	contacts := make([]ContactDistance, 0)
+	for _, bucket := range rt.buckets {
+		for e := bucket.Front(); e != nil; e = e.Next() {
+			c := e.Value.(Contact)
+			if !c.NodeID.Equals(exclude) {
+				contacts = append(contacts, ContactDistance{c, c.NodeID.Xor(target)})
+			}
+		}
+	}
+	rt.mutex.RUnlock()
+
+	sort.Sort(ByDistance(contacts))
+	if len(contacts) > count {
+		contacts = contacts[:count]
+	}
+	result := make([]Contact, len(contacts))
+	for i := range contacts {
+		result[i] = contacts[i].SelfContact
+	}
+	return result
+}
+
+//indexes of the buckets holding contacts
+func (rt *RoutingTable) nonEmptyBuckets() []int {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+	var indexes []int
+	for i, bucket := range rt.buckets {
+		if bucket.Len() > 0 {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+//the following need mutex held
+
+func (rt *RoutingTable) addReplacement(bucketIndex int, contact Contact) {
+	cache := rt.replacements[bucketIndex]
+	if e := findInList(cache, contact.NodeID); e != nil {
+		cache.Remove(e)
+	}
+	cache.PushBack(contact)
+	if cache.Len() > REPLACEMENT_CACHE_SIZE {
+		cache.Remove(cache.Front())
+	}
+}
+
+func (rt *RoutingTable) removeReplacement(bucketIndex int, nodeId ID) {
+	cache := rt.replacements[bucketIndex]
+	if e := findInList(cache, nodeId); e != nil {
+		cache.Remove(e)
+	}
+}
+
+//remove a bucket contact and move the most recently seen replacement into
+//the bucket
+func (rt *RoutingTable) replaceContact(bucketIndex int, e *list.Element) {
+	rt.buckets[bucketIndex].Remove(e)
+	cache := rt.replacements[bucketIndex]
+	if last := cache.Back(); last != nil {
+		cache.Remove(last)
+		rt.buckets[bucketIndex].PushBack(last.Value.(Contact))
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"errors"
 	// "fmt"
 	"net"
+	"time"
 )
 
 type KademliaCore struct {
@@ -26,26 +27,34 @@ type Contact struct {
 ///////////////////////////////////////////////////////////////////////////////
 
 type GetVDORequest struct {
+	inbound
+	Signed `json:"-"`
 	Sender Contact
 	MsgID  ID
 	VdoID  ID
 }
 
 type GetVDOResult struct {
-	MsgID ID
-	VDO   VanashingDataObject
+	Signed `json:"-"`
+	MsgID  ID
+	VDO    VanashingDataObject
 }
 
 func (kc *KademliaCore) GetVDO(req GetVDORequest, res *GetVDOResult) error {
 	k := (*kc).kademlia
 
-	// test if key exists in map, if exists, ok = true
-	k.storeMutex.RLock()
-	value, ok := k.vdoMap[req.VdoID]
-	k.storeMutex.RUnlock()
+	// test if key exists in store, if exists, ok = true
+	stored, ok, err := k.vdos.Get(req.VdoID)
+	if err != nil {
+		return err
+	}
 
 	//if key exists
 	if ok {
+		value, err := UnmarshalVDO(stored.Value)
+		if err != nil {
+			return err
+		}
 		res.MsgID = req.MsgID
 		res.VDO = value
 	}
@@ -57,11 +66,17 @@ func (kc *KademliaCore) GetVDO(req GetVDORequest, res *GetVDOResult) error {
 // PING
 ///////////////////////////////////////////////////////////////////////////////
 type PingMessage struct {
+	inbound
+	Signed `json:"-"`
 	Sender Contact
 	MsgID  ID
+	//sent to confirm the receiver as a contact, who doesn't confirm the
+	//sender back
+	Confirm bool
 }
 
 type PongMessage struct {
+	Signed `json:"-"`
 	MsgID  ID
 	Sender Contact
 }
@@ -77,7 +92,9 @@ func (kc *KademliaCore) Ping(ping PingMessage, pong *PongMessage) error {
 
 	// fmt.Println("Received ping!")
 	// Update contact, etc
-	kc.kademlia.UpdateContact(ping.Sender)
+	if !ping.Confirm {
+		kc.kademlia.senderSeen(ping.Sender, ping.remoteIP)
+	}
 
 	return nil
 }
@@ -85,31 +102,40 @@ func (kc *KademliaCore) Ping(ping PingMessage, pong *PongMessage) error {
 ///////////////////////////////////////////////////////////////////////////////
 // STORE
 ///////////////////////////////////////////////////////////////////////////////
+// TTL is how long the value should live, the receiver uses its default for 0
+// and caps it by its own policy.
 type StoreRequest struct {
+	inbound
+	Signed `json:"-"`
 	Sender Contact
 	MsgID  ID
 	Key    ID
 	Value  []byte
+	TTL    time.Duration
 }
 
+// Err is a *StoreRefusedError when the value was refused.
 type StoreResult struct {
-	MsgID ID
-	Err   error
+	Signed `json:"-"`
+	MsgID  ID
+	Err    error
 }
 
 func (kc *KademliaCore) Store(req StoreRequest, res *StoreResult) error {
 	// fmt.Println("Begin store!")
 	k := (*kc).kademlia
+	res.MsgID = req.MsgID
 	// store
-	k.storeMutex.Lock()
-	k.storeMap[req.Key] = req.Value
-	// fmt.Println("store ")
-	// fmt.Println(k.storeMap[req.Key])
-	k.storeMutex.Unlock()
+	err := k.storeValueFrom(req.storeSender(req.Sender), req.Key, req.Value, req.TTL)
+	var refused *StoreRefusedError
+	if errors.As(err, &refused) {
+		res.Err = refused
+	} else if err != nil {
+		return err
+	}
 
 	//update contact
-	k.UpdateContact(req.Sender)
-	res.Err = nil
+	k.senderSeen(req.Sender, req.remoteIP)
 	// fmt.Println("Finish store " + string(req.Value) + "on " + k.NodeID.AsString())
 	return nil
 }
@@ -118,15 +144,18 @@ func (kc *KademliaCore) Store(req StoreRequest, res *StoreResult) error {
 // FIND_NODE
 ///////////////////////////////////////////////////////////////////////////////
 type FindNodeRequest struct {
+	inbound
+	Signed `json:"-"`
 	Sender Contact
 	MsgID  ID
 	NodeID ID
 }
 
 type FindNodeResult struct {
-	MsgID ID
-	Nodes []Contact
-	Err   error
+	Signed `json:"-"`
+	MsgID  ID
+	Nodes  []Contact
+	Err    error
 }
 
 func (kc *KademliaCore) FindNode(req FindNodeRequest, res *FindNodeResult) error {
@@ -136,7 +165,7 @@ func (kc *KademliaCore) FindNode(req FindNodeRequest, res *FindNodeResult) error
 	res.MsgID = req.MsgID
 
 	//update contact
-	k.UpdateContact(req.Sender)
+	k.senderSeen(req.Sender, req.remoteIP)
 	return nil
 }
 
@@ -144,61 +173,168 @@ func (kc *KademliaCore) FindNode(req FindNodeRequest, res *FindNodeResult) error
 // FIND_VALUE
 ///////////////////////////////////////////////////////////////////////////////
 type FindValueRequest struct {
+	inbound
+	Signed `json:"-"`
 	Sender Contact
 	MsgID  ID
 	Key    ID
 }
 
 // If Value is nil, it should be ignored, and Nodes means the same as in a
-// FindNodeResult.
+// FindNodeResult. TTL is how long the value has left on the node.
 type FindValueResult struct {
-	MsgID ID
-	Value []byte
-	Nodes []Contact
-	Err   error
+	Signed `json:"-"`
+	MsgID  ID
+	Value  []byte
+	Nodes  []Contact
+	Err    error
+	TTL    time.Duration
 }
 
 func (kc *KademliaCore) FindValue(req FindValueRequest, res *FindValueResult) error {
 	k := (*kc).kademlia
 
 	// test if key exists in map, if exists, ok = true
-	k.storeMutex.RLock()
-	value, ok := k.storeMap[req.Key]
-	k.storeMutex.RUnlock()
+	value, ttl, ok := k.localValue(req.Key)
 
 	//if key exists
 	if ok {
 		res.MsgID = req.MsgID
 		res.Value = value
+		res.TTL = ttl
 		res.Nodes = nil
 		res.Err = nil
 
 		//if not found,  Otherwise the RPC is equivalent to a FIND_NODE and a set of k triples is returned.
 	} else {
+		//answer as FindNode does, the sender is noted once below
+		res.MsgID = req.MsgID
+		res.Value = nil
+		res.Nodes = k.FindClosestContacts(req.Key, req.Sender.NodeID)
+		res.Err = nil
+	}
 
-		//create find node request and result
-		findNodeRequest := new(FindNodeRequest)
-		findNodeRequest.Sender = req.Sender
-		findNodeRequest.MsgID = NewRandomID()
-		findNodeRequest.NodeID = req.Key
+	//update contact
+	k.senderSeen(req.Sender, req.remoteIP)
 
-		findNodeRes := new(FindNodeResult)
+	return nil
+}
 
-		//find node
-		err := kc.FindNode(*findNodeRequest, findNodeRes)
-		if err != nil {
-			res.Err = errors.New("Find Node Error")
+///////////////////////////////////////////////////////////////////////////////
+// STORE_BATCH
+///////////////////////////////////////////////////////////////////////////////
+// One value of a StoreBatchRequest, TTL means the same as in a StoreRequest.
+type StoreItem struct {
+	Key   ID
+	Value []byte
+	TTL   time.Duration
+}
+
+type StoreBatchRequest struct {
+	inbound
+	Signed `json:"-"`
+	Sender Contact
+	MsgID  ID
+	Items  []StoreItem
+}
+
+// Refused holds the indexes of the items that were refused, and Err the
+// *StoreRefusedError of the first of them.
+type StoreBatchResult struct {
+	Signed  `json:"-"`
+	MsgID   ID
+	Refused []int
+	Err     error
+}
+
+func (kc *KademliaCore) StoreBatch(req StoreBatchRequest, res *StoreBatchResult) error {
+	k := (*kc).kademlia
+	for i, item := range req.Items {
+		err := k.storeValueFrom(req.storeSender(req.Sender), item.Key, item.Value, item.TTL)
+		var refused *StoreRefusedError
+		if errors.As(err, &refused) {
+			res.Refused = append(res.Refused, i)
+			if res.Err == nil {
+				res.Err = refused
+			}
+		} else if err != nil {
+			return err
 		}
+	}
 
-		res.MsgID = req.MsgID
-		res.Value = nil
-		res.Nodes = findNodeRes.Nodes
-		res.Err = nil
+	//update contact
+	k.senderSeen(req.Sender, req.remoteIP)
+	res.MsgID = req.MsgID
+	return nil
+}
 
+///////////////////////////////////////////////////////////////////////////////
+// FIND_NODE_BATCH
+///////////////////////////////////////////////////////////////////////////////
+type FindNodeBatchRequest struct {
+	inbound
+	Signed  `json:"-"`
+	Sender  Contact
+	MsgID   ID
+	NodeIDs []ID
+}
+
+// Nodes[i] is what FindNode of NodeIDs[i] would return.
+type FindNodeBatchResult struct {
+	Signed `json:"-"`
+	MsgID  ID
+	Nodes  [][]Contact
+	Err    error
+}
+
+func (kc *KademliaCore) FindNodeBatch(req FindNodeBatchRequest, res *FindNodeBatchResult) error {
+	k := (*kc).kademlia
+	res.MsgID = req.MsgID
+	res.Nodes = make([][]Contact, len(req.NodeIDs))
+	for i, nodeID := range req.NodeIDs {
+		res.Nodes[i] = k.FindClosestContacts(nodeID, req.Sender.NodeID)
 	}
 
 	//update contact
-	k.UpdateContact(req.Sender)
+	k.senderSeen(req.Sender, req.remoteIP)
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////
+// FIND_VALUE_BATCH
+///////////////////////////////////////////////////////////////////////////////
+type FindValueBatchRequest struct {
+	inbound
+	Signed `json:"-"`
+	Sender Contact
+	MsgID  ID
+	Keys   []ID
+}
 
+// Results[i] is the FindValueResult for Keys[i].
+type FindValueBatchResult struct {
+	Signed  `json:"-"`
+	MsgID   ID
+	Results []FindValueResult
+	Err     error
+}
+
+func (kc *KademliaCore) FindValueBatch(req FindValueBatchRequest, res *FindValueBatchResult) error {
+	k := (*kc).kademlia
+	res.MsgID = req.MsgID
+	res.Results = make([]FindValueResult, len(req.Keys))
+	for i, key := range req.Keys {
+		result := &res.Results[i]
+		result.MsgID = req.MsgID
+		if value, ttl, ok := k.localValue(key); ok {
+			result.Value = value
+			result.TTL = ttl
+		} else {
+			result.Nodes = k.FindClosestContacts(key, req.Sender.NodeID)
+		}
+	}
+
+	//update contact
+	k.senderSeen(req.Sender, req.remoteIP)
 	return nil
 }
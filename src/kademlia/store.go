@@ -0,0 +1,103 @@
+package kademlia
+
+// Contains the Store interface a node keeps its data in, and the in-memory
+// Store used by default. A node opens one Store for the values it holds, one
+// for the values it published and one for its VDOs, so a persistent Store
+// lets a restarted node keep holding and republishing them.
+
+import (
+	"sync"
+	"time"
+)
+
+// Names of the stores a node opens.
+const (
+	STORE_VALUES    = "values"
+	STORE_PUBLISHED = "published"
+	STORE_VDOS      = "vdos"
+)
+
+// A stored value. Expires is when it should be deleted, never when zero, and
+// Stored is when it was last stored.
+type StoreEntry struct {
+	Value   []byte
+	Expires time.Time
+	Stored  time.Time
+}
+
+// Where a node keeps what it stores. Expired entries are kept until deleted,
+// the node checks Expires itself. Implementations must be safe for
+// concurrent use, and Iterate must allow f to call Put and Delete.
+type Store interface {
+	Put(key ID, entry StoreEntry) error
+	Get(key ID) (StoreEntry, bool, error)
+	Delete(key ID) error
+	//call f for every entry until it returns false
+	Iterate(f func(key ID, entry StoreEntry) bool) error
+	Close() error
+}
+
+// Opens the store a node keeps name in, one of the STORE_ names.
+type StoreOpener func(name string) (Store, error)
+
+// A Store that keeps everything in memory, lost when the node stops.
+type MemoryStore struct {
+	mutex   sync.RWMutex
+	entries map[ID]StoreEntry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[ID]StoreEntry)}
+}
+
+// A StoreOpener of MemoryStores.
+func OpenMemoryStore(name string) (Store, error) {
+	return NewMemoryStore(), nil
+}
+
+func (s *MemoryStore) Put(key ID, entry StoreEntry) error {
+	s.mutex.Lock()
+	s.entries[key] = entry
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) Get(key ID) (StoreEntry, bool, error) {
+	s.mutex.RLock()
+	entry, ok := s.entries[key]
+	s.mutex.RUnlock()
+	return entry, ok, nil
+}
+
+func (s *MemoryStore) Delete(key ID) error {
+	s.mutex.Lock()
+	delete(s.entries, key)
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *MemoryStore) Iterate(f func(key ID, entry StoreEntry) bool) error {
+	return iterateSnapshot(&s.mutex, s.entries, f)
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+//call f on a copy of entries taken under mutex, so f may change them
+func iterateSnapshot(mutex *sync.RWMutex, entries map[ID]StoreEntry, f func(key ID, entry StoreEntry) bool) error {
+	mutex.RLock()
+	keys := make([]ID, 0, len(entries))
+	snapshot := make([]StoreEntry, 0, len(entries))
+	for key, entry := range entries {
+		keys = append(keys, key)
+		snapshot = append(snapshot, entry)
+	}
+	mutex.RUnlock()
+	for i, key := range keys {
+		if !f(key, snapshot[i]) {
+			break
+		}
+	}
+	return nil
+}
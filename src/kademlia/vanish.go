@@ -1,41 +1,105 @@
 package kademlia
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hkdf"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	mathrand "math/rand"
 	"sss"
-	// "strconv"
-	"strings"
 	"time"
 )
 
-const Hour time.Duration = 1500 * time.Minute
+// Shares are republished to the new epoch's locations every EPOCH_LENGTH
+// and live long enough to be found from the next epoch too. Epochs are
+// counted from the Unix epoch in UTC, so every node agrees on them whatever
+// its time zone.
+const (
+	EPOCH_LENGTH time.Duration = 8 * time.Hour
+	SHARE_TTL    time.Duration = 2 * EPOCH_LENGTH
+)
+
+// Ciphertext formats of a VDO. Version 0 is the original unauthenticated
+// AES-CFB format, it is only kept so that old VDOs can still be read.
+// VDO_VERSION_GCM_STREAM seals the data in VDO_SEGMENT_BYTES segments, so the
+// key can be checked on the first segment before any plaintext is written.
+// The whole ciphertext is still kept in the VDO, in memory.
+const (
+	VDO_VERSION_CFB        byte = 0
+	VDO_VERSION_GCM        byte = 1
+	VDO_VERSION_GCM_STREAM byte = 2
+	VDO_VERSION                 = VDO_VERSION_GCM
+)
+
+const VDO_SEGMENT_BYTES = 64 * 1024
+
+// Returned by UnvanishData when the shares found in the DHT do not open the
+// ciphertext, either because they are gone or because they were tampered with.
+var ErrVDOExpired = errors.New("key expired or corrupted")
 
+// Length of the data key and of the per-VDO location secret.
+const (
+	CRYPTO_KEY_BYTES = 32
+	ACCESS_KEY_BYTES = 32
+)
+
+// AccessKey is only set on VDO_VERSION_CFB objects, whose shares live at
+// locations shared by every VDO of the epoch. Newer objects derive their
+// share locations from their own LocationSeed.
 type VanashingDataObject struct {
-	AccessKey  int64
-	Ciphertext []byte
-	NumberKeys byte
-	Threshold  byte
+	AccessKey    int64
+	Ciphertext   []byte
+	NumberKeys   byte
+	Threshold    byte
+	Version      byte
+	Epoch        int64
+	LocationSeed []byte
 }
 
-func GenerateRandomCryptoKey() (ret []byte) {
-	for i := 0; i < 32; i++ {
-		ret = append(ret, uint8(mathrand.Intn(256)))
+func randomBytes(n int) []byte {
+	ret := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, ret); err != nil {
+		panic(err)
 	}
-	return
+	return ret
 }
 
-func GenerateRandomAccessKey() (accessKey int64) {
-	r := mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
-	accessKey = r.Int63()
+func GenerateRandomCryptoKey() (ret []byte) {
+	return randomBytes(CRYPTO_KEY_BYTES)
+}
+
+//per-VDO secret the share locations are derived from
+func GenerateRandomAccessKey() (accessKey []byte) {
+	return randomBytes(ACCESS_KEY_BYTES)
+}
+
+//derive the share locations of an epoch from the VDO's secret, without the
+//secret the locations of one epoch tell nothing about any other VDO or epoch
+func CalculateSharedKeyLocations(accessKey []byte, epoch int64, count int64) (ids []ID) {
+	info := make([]byte, 8)
+	binary.BigEndian.PutUint64(info, uint64(epoch))
+	locations, err := hkdf.Key(sha256.New, accessKey, nil, "vanish share locations "+string(info), int(count)*IDBytes)
+	if err != nil {
+		panic(err)
+	}
+	ids = make([]ID, count)
+	for i := int64(0); i < count; i++ {
+		copy(ids[i][:], locations[int(i)*IDBytes:])
+	}
 	return
 }
 
-func CalculateSharedKeyLocations(accessKey int64, count int64) (ids []ID) {
+//share locations of VDO_VERSION_CFB objects
+func calculateLegacySharedKeyLocations(accessKey int64, count int64) (ids []ID) {
 	r := mathrand.New(mathrand.NewSource(accessKey))
 	ids = make([]ID, count)
 	for i := int64(0); i < count; i++ {
@@ -46,38 +110,178 @@ func CalculateSharedKeyLocations(accessKey int64, count int64) (ids []ID) {
 	return
 }
 
-func encrypt(key []byte, text []byte) (ciphertext []byte) {
+//metadata authenticated together with the ciphertext, so a VDO whose
+//threshold, number of keys or epoch was changed does not open either
+func vdoAssociatedData(vdo *VanashingDataObject) []byte {
+	ad := make([]byte, 3+8)
+	ad[0] = vdo.Version
+	ad[1] = vdo.NumberKeys
+	ad[2] = vdo.Threshold
+	binary.BigEndian.PutUint64(ad[3:], uint64(vdo.Epoch))
+	return ad
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//seal text with AES-GCM, the nonce is prepended to the ciphertext
+func seal(key []byte, text []byte, ad []byte) (ciphertext []byte) {
+	aead, err := newGCM(key)
 	if err != nil {
 		panic(err)
 	}
-	ciphertext = make([]byte, aes.BlockSize+len(text))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		panic(err)
 	}
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(ciphertext[aes.BlockSize:], text)
-	return
+	return aead.Seal(nonce, nonce, text, ad)
+}
+
+func open(key []byte, ciphertext []byte, ad []byte) (text []byte, err error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, ErrVDOExpired
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrVDOExpired
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	text, err = aead.Open(nil, nonce, ciphertext[aead.NonceSize():], ad)
+	if err != nil {
+		return nil, ErrVDOExpired
+	}
+	return text, nil
 }
 
-func decrypt(key []byte, ciphertext []byte) (text []byte) {
+//a stream ciphertext is a random nonce prefix followed by the sealed
+//segments, each segment's nonce is the prefix, its index and whether it is
+//the last one, so segments can't be reordered, dropped or truncated
+const streamPrefixBytes = 7
+
+func streamNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, streamPrefixBytes+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[streamPrefixBytes:], index)
+	if last {
+		nonce[streamPrefixBytes+4] = 1
+	}
+	return nonce
+}
+
+func sealStream(key []byte, r io.Reader, ad []byte) (ciphertext []byte, err error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	in := bufio.NewReaderSize(r, VDO_SEGMENT_BYTES)
+	prefix := randomBytes(streamPrefixBytes)
+	ciphertext = append(ciphertext, prefix...)
+	segment := make([]byte, VDO_SEGMENT_BYTES)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(in, segment)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		last := err != nil
+		if !last {
+			if _, err := in.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+		ciphertext = aead.Seal(ciphertext, streamNonce(prefix, index, last), segment[:n], ad)
+		if last {
+			return ciphertext, nil
+		}
+	}
+}
+
+//split a stream ciphertext into its nonce prefix and sealed segments
+func streamSegments(ciphertext []byte, overhead int) (prefix []byte, segments [][]byte, err error) {
+	if len(ciphertext) < streamPrefixBytes+overhead {
+		return nil, nil, ErrVDOExpired
+	}
+	prefix = ciphertext[:streamPrefixBytes]
+	rest := ciphertext[streamPrefixBytes:]
+	for len(rest) > VDO_SEGMENT_BYTES+overhead {
+		segments = append(segments, rest[:VDO_SEGMENT_BYTES+overhead])
+		rest = rest[VDO_SEGMENT_BYTES+overhead:]
+	}
+	if len(rest) < overhead {
+		return nil, nil, ErrVDOExpired
+	}
+	return prefix, append(segments, rest), nil
+}
+
+//open the segments of a stream ciphertext and write them to w, with
+//firstOnly set only the first segment is opened, which checks the key
+func openStream(key []byte, ciphertext []byte, ad []byte, w io.Writer, firstOnly bool) error {
+	aead, err := newGCM(key)
+	if err != nil {
+		return ErrVDOExpired
+	}
+	prefix, segments, err := streamSegments(ciphertext, aead.Overhead())
+	if err != nil {
+		return err
+	}
+	var text []byte
+	for i, segment := range segments {
+		nonce := streamNonce(prefix, uint32(i), i == len(segments)-1)
+		text, err = aead.Open(text[:0], nonce, segment, ad)
+		if err != nil {
+			return ErrVDOExpired
+		}
+		if firstOnly {
+			return nil
+		}
+		if _, err := w.Write(text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//legacy AES-CFB decryption for VDO_VERSION_CFB objects
+func decrypt(key []byte, ciphertext []byte) (text []byte, err error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err)
+		return nil, ErrVDOExpired
 	}
 	if len(ciphertext) < aes.BlockSize {
-		panic("ciphertext is not long enough")
+		return nil, ErrVDOExpired
 	}
 	iv := ciphertext[:aes.BlockSize]
-	ciphertext = ciphertext[aes.BlockSize:]
+	text = make([]byte, len(ciphertext)-aes.BlockSize)
 
 	stream := cipher.NewCFBDecrypter(block, iv)
-	stream.XORKeyStream(ciphertext, ciphertext)
-	return ciphertext
+	stream.XORKeyStream(text, ciphertext[aes.BlockSize:])
+	return text, nil
 }
 
-func GetEpochAccessKey(epochType int) (accessKey int64) {
+//decrypt the ciphertext of a vdo according to its version
+func decryptVDO(key []byte, vdo *VanashingDataObject) ([]byte, error) {
+	switch vdo.Version {
+	case VDO_VERSION_CFB:
+		return decrypt(key, vdo.Ciphertext)
+	case VDO_VERSION_GCM:
+		return open(key, vdo.Ciphertext, vdoAssociatedData(vdo))
+	case VDO_VERSION_GCM_STREAM:
+		var buf bytes.Buffer
+		if err := openStream(key, vdo.Ciphertext, vdoAssociatedData(vdo), &buf, false); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, errors.New("unknown VDO version")
+}
+
+// Local time epochs that VDO_VERSION_CFB objects were stored under, newer
+// objects use the UTC epochs of epochStart.
+func GetEpochTime(epochType int) time.Time {
 	//Divide 24 hour into epochType
 	//0 is current, 1 is prevoius, 2 is later
 	currentTime := time.Now()
@@ -103,129 +307,262 @@ func GetEpochAccessKey(epochType int) (accessKey int64) {
 	} else {
 		currentEpochHour = 0
 	}
-	resultTime := time.Date(currentYear, currentMonth, currentDay, currentEpochHour, 0, 0, 0, currentLocation)
+	return time.Date(currentYear, currentMonth, currentDay, currentEpochHour, 0, 0, 0, currentLocation)
+}
+
+//start of the epoch offset epochs from the one t is in, in Unix seconds
+func epochStart(t time.Time, offset int) int64 {
+	length := int64(EPOCH_LENGTH / time.Second)
+	return (t.Unix()/length + int64(offset)) * length
+}
+
+//start of the epoch offset epochs from the current one by k's clock
+func (k *Kademlia) epoch(offset int) int64 {
+	return epochStart(k.config.Clock.Now(), offset)
+}
+
+//epoch-wide access key, only used to find the shares of VDO_VERSION_CFB objects
+func GetEpochAccessKey(epochType int) (accessKey int64) {
+	resultTime := GetEpochTime(epochType)
 	r := mathrand.New(mathrand.NewSource(resultTime.UnixNano()))
 	accessKey = r.Int63()
 	return
 }
 
-func VanishData(kadem Kademlia, data []byte, numberKeys byte,
-	threshold byte, validPeriod int) (vdo VanashingDataObject) {
-	k := GenerateRandomCryptoKey()
-	ciphertext := encrypt(k, data)
-	splitKeysMap, err := sss.Split(numberKeys, threshold, k)
-	vdo = *new(VanashingDataObject)
+//a vdo created in epoch with its metadata and a fresh location seed, but no
+//ciphertext yet
+func newVDO(version byte, numberKeys byte, threshold byte, epoch int64) (vdo VanashingDataObject) {
+	vdo.Version = version
+	vdo.NumberKeys = numberKeys
+	vdo.Threshold = threshold
+	vdo.Epoch = epoch
+	vdo.LocationSeed = GenerateRandomAccessKey()
+	return
+}
 
+//store share i+1 at randomSequence[i], all shares are stored by one batched
+//lookup that gives up after LOOKUP_TIMEOUT. It fails unless at least
+//threshold shares were stored.
+func storeShares(ctx context.Context, kadem *Kademlia, splitKeysMap map[byte][]byte, randomSequence []ID, threshold byte) error {
+	items := make([]StoreItem, len(randomSequence))
+	for i := 0; i < len(randomSequence); i++ {
+		k := byte(i + 1)
+		v := splitKeysMap[k]
+		items[i] = StoreItem{randomSequence[i], append([]byte{k}, v...), SHARE_TTL}
+	}
+	//the shares are not published, vanishKey republishes them while the vdo
+	//is valid and no copy of them is kept here
+	lookupCtx, cancel := context.WithTimeout(ctx, LOOKUP_TIMEOUT)
+	stored, err := kadem.storeClosestBatch(lookupCtx, items)
+	cancel()
+	if ctx.Err() != nil {
+		return contextError(ctx, ctx.Err())
+	}
+	//the vdo can still be unvanished with some shares lost
+	if stored < int(threshold) {
+		return fmt.Errorf("only %d of %d key shares stored, %d needed: %w", stored, len(items), threshold, err)
+	}
+	return nil
+}
+
+//split the data key of a vdo and store the shares at the vdo's locations
+func vanishKey(ctx context.Context, kadem *Kademlia, vdo *VanashingDataObject, k []byte, validPeriod int) error {
+	numberKeys, threshold := vdo.NumberKeys, vdo.Threshold
+	splitKeysMap, err := sss.Split(numberKeys, threshold, k)
 	if err != nil {
-		return vdo
+		return err
 	}
 
-	accessKey := GetEpochAccessKey(0)
-	randomSequence := CalculateSharedKeyLocations(accessKey, int64(numberKeys))
+	accessKey := vdo.LocationSeed
+	randomSequence := CalculateSharedKeyLocations(accessKey, vdo.Epoch, int64(numberKeys))
 
 	//store keys
-	for i := 0; i < len(randomSequence); i++ {
-		k := byte(i + 1)
-		v := splitKeysMap[k]
-		all := append([]byte{k}, v...)
-		kadem.DoIterativeStore(randomSequence[i], all)
+	if err := storeShares(ctx, kadem, splitKeysMap, randomSequence, threshold); err != nil {
+		return err
 	}
-	// validPeriod means how many epoch does the user want to extend the peroid, since wo don't have so many echanges among nodes
-	//we refresh the key each 8 hour
+	// validPeriod means how many hours does the user want to extend the peroid, since wo don't have so many echanges among nodes
 	if validPeriod > 0 {
-		ticker := time.NewTicker(Hour * 8)
-		stop := make(chan int)
-		go func() {
-			for {
-				select {
-				case <-ticker.C:
-					// republish
-					accessKey = GetEpochAccessKey(0)
-					randomSequence := CalculateSharedKeyLocations(accessKey, int64(numberKeys))
-					
-					//store keys
-					for i := 0; i < len(randomSequence); i++ {
-						k := byte(i + 1)
-						v := splitKeysMap[k]
-						all := append([]byte{k}, v...)
-						kadem.DoIterativeStore(randomSequence[i], all)
-					}
-
-					validPeriod = validPeriod - 8
-
-					//after valid time period the data expires
-					if validPeriod <= 0 {
-						stop <- 1
-					}
-
-				case <-stop:
-					ticker.Stop()
-					return
-				default:
+		until := kadem.config.Clock.Now().Add(time.Duration(validPeriod) * time.Hour)
+		go republishShares(kadem, *vdo, splitKeysMap, time.Unix(kadem.epoch(1), 0), until)
+	}
 
-				}
+	return nil
+}
+
+//store the shares of a vdo at its locations of each epoch from the one
+//starting at next that starts before until, as the epoch starts by kadem's
+//clock, until kadem is closed
+func republishShares(kadem *Kademlia, vdo VanashingDataObject, splitKeysMap map[byte][]byte, next time.Time, until time.Time) {
+	clock := kadem.config.Clock
+	for ; next.Before(until); next = next.Add(EPOCH_LENGTH) {
+		if wait := next.Sub(clock.Now()); wait > 0 {
+			select {
+			case <-clock.After(wait):
+			case <-kadem.done:
+				return
 			}
-		}()
+		}
+		// republish to this VDO's locations for the new epoch
+		randomSequence := CalculateSharedKeyLocations(vdo.LocationSeed, next.Unix(), int64(vdo.NumberKeys))
+		if err := storeShares(context.Background(), kadem, splitKeysMap, randomSequence, vdo.Threshold); err != nil {
+			log.Println("republish key shares:", err)
+		}
 	}
+}
 
-	//create vdo object
+func VanishData(ctx context.Context, kadem *Kademlia, data []byte, numberKeys byte,
+	threshold byte, validPeriod int) (vdo VanashingDataObject, err error) {
+	k := GenerateRandomCryptoKey()
+	vdo = newVDO(VDO_VERSION, numberKeys, threshold, kadem.epoch(0))
+	vdo.Ciphertext = seal(k, data, vdoAssociatedData(&vdo))
 
-	vdo.AccessKey = accessKey
-	vdo.Ciphertext = ciphertext
-	vdo.NumberKeys = numberKeys
-	vdo.Threshold = threshold
+	if err := vanishKey(ctx, kadem, &vdo, k, validPeriod); err != nil {
+		return VanashingDataObject{}, err
+	}
 	return
 }
 
-func UnvanishData(kadem Kademlia, vdo VanashingDataObject) (data []byte) {
-	//accessKey := vdo.AccessKey
-	ciphertext := vdo.Ciphertext
-	numberOfKeys := vdo.NumberKeys
+//vanish everything read from r, the data is sealed segment by segment but
+//the VDO holds all of the ciphertext
+func VanishReader(ctx context.Context, kadem *Kademlia, r io.Reader, numberKeys byte,
+	threshold byte, validPeriod int) (vdo VanashingDataObject, err error) {
+	k := GenerateRandomCryptoKey()
+	vdo = newVDO(VDO_VERSION_GCM_STREAM, numberKeys, threshold, kadem.epoch(0))
+	vdo.Ciphertext, err = sealStream(k, r, vdoAssociatedData(&vdo))
+	if err != nil {
+		return
+	}
+	err = vanishKey(ctx, kadem, &vdo, k, validPeriod)
+	return
+}
+
+//combine the shares into the data key, shares of different length can only
+//come from a corrupted or forged share
+func combineShares(splitKeysMap map[byte][]byte) ([]byte, error) {
+	length := -1
+	for _, v := range splitKeysMap {
+		if length != -1 && len(v) != length {
+			return nil, ErrVDOExpired
+		}
+		length = len(v)
+	}
+	return sss.Combine(splitKeysMap), nil
+}
+
+//share locations of a vdo for each epoch it may currently be stored under:
+//the epoch it was created in, then the current, previous and next epoch by
+//kadem's clock
+func vdoShareLocations(kadem *Kademlia, vdo *VanashingDataObject) (locations [][]ID) {
+	numberOfKeys := int64(vdo.NumberKeys)
+	if vdo.Version == VDO_VERSION_CFB {
+		for j := 0; j < 3; j++ {
+			locations = append(locations, calculateLegacySharedKeyLocations(GetEpochAccessKey(j), numberOfKeys))
+		}
+		return
+	}
+
+	epochs := []int64{vdo.Epoch}
+	for _, offset := range []int{0, -1, 1} {
+		epoch := kadem.epoch(offset)
+		if epoch != vdo.Epoch {
+			epochs = append(epochs, epoch)
+		}
+	}
+	for _, epoch := range epochs {
+		locations = append(locations, CalculateSharedKeyLocations(vdo.LocationSeed, epoch, numberOfKeys))
+	}
+	return
+}
+
+//find the shares of a vdo and combine them into the first key that passes
+//check, check must fail for keys that don't open the vdo. Each location
+//takes the share most of its closest nodes returned, the other shares found
+//are tried one at a time if the key doesn't pass.
+func unvanishKey(ctx context.Context, kadem *Kademlia, vdo *VanashingDataObject, check func([]byte) error) ([]byte, error) {
 	threShold := vdo.Threshold
 	splitKeysMap := make(map[byte][]byte)
+	var others [][]byte
 
-	for j := 0; j < 3; j++ {
-		//Get access key by current epoch, try all three epochs
-		accessKey := GetEpochAccessKey(j)
-		randomSequence := CalculateSharedKeyLocations(accessKey, int64(numberOfKeys))
-		//store keys
-		for i := 0; i < len(randomSequence); i++ {
-			resString := kadem.DoIterativeFindValue(randomSequence[i])
-			indexV := strings.Index(resString, "Value:")
-
-			if indexV != -1 {
-				indexV = indexV + 7
-				resString = resString[indexV:]
-				if len(resString) > 1 {
-					resultByte := []byte(resString)
-					v := resultByte[1:]
-					k := resultByte[0:1]
-					for inde := range k {
-						key := k[inde]
-						splitKeysMap[byte(key)] = v
-
-						break
-					}
+	for _, randomSequence := range vdoShareLocations(kadem, vdo) {
+		//find keys, all locations in one batched lookup
+		lookupCtx, cancel := context.WithTimeout(ctx, LOOKUP_TIMEOUT)
+		shares, err := kadem.IterativeFindValuesBatch(lookupCtx, randomSequence)
+		cancel()
+		if ctx.Err() != nil {
+			return nil, contextError(ctx, ctx.Err())
+		}
+		if err != nil {
+			continue
+		}
+		for _, values := range shares {
+			found := false
+			for _, v := range values {
+				if len(v.Value) < 2 {
+					continue
 				}
-				if int64(len(splitKeysMap)) == int64(threShold) {
-					break
+				//the first byte of a share is its index
+				if _, ok := splitKeysMap[v.Value[0]]; found || ok {
+					others = append(others, v.Value)
+					continue
 				}
+				splitKeysMap[v.Value[0]] = v.Value[1:]
+				found = true
+			}
+			if int64(len(splitKeysMap)) == int64(threShold) {
+				break
+			}
+		}
 
-			} else {
+		if int64(len(splitKeysMap)) < int64(threShold) {
+			continue
+		}
+		if secretKey, err := combineShares(splitKeysMap); err == nil && check(secretKey) == nil {
+			return secretKey, nil
+		}
+		for _, other := range others {
+			index := other[0]
+			share, ok := splitKeysMap[index]
+			if !ok {
 				continue
 			}
+			splitKeysMap[index] = other[1:]
+			if secretKey, err := combineShares(splitKeysMap); err == nil && check(secretKey) == nil {
+				return secretKey, nil
+			}
+			splitKeysMap[index] = share
 		}
+	}
+	return nil, ErrVDOExpired
+}
 
-		if int64(len(splitKeysMap)) >= int64(threShold) {
-			//fmt.Println("How many we have:" + strconv.Itoa(int(len(splitKeysMap))))
-			secretKey := sss.Combine(splitKeysMap)
-			data = decrypt(secretKey, ciphertext)
-			fmt.Print("=================Data is: ")
-			fmt.Print(data)
-			if data != nil {
-				return
-			}
+func UnvanishData(ctx context.Context, kadem *Kademlia, vdo VanashingDataObject) (data []byte, err error) {
+	_, err = unvanishKey(ctx, kadem, &vdo, func(key []byte) (err error) {
+		data, err = decryptVDO(key, &vdo)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+//unvanish a vdo into w, the key is checked before anything is written
+func UnvanishWriter(ctx context.Context, kadem *Kademlia, vdo VanashingDataObject, w io.Writer) error {
+	if vdo.Version != VDO_VERSION_GCM_STREAM {
+		data, err := UnvanishData(ctx, kadem, vdo)
+		if err != nil {
+			return err
 		}
+		_, err = w.Write(data)
+		return err
 	}
-	return
+
+	ad := vdoAssociatedData(&vdo)
+	key, err := unvanishKey(ctx, kadem, &vdo, func(key []byte) error {
+		return openStream(key, vdo.Ciphertext, ad, nil, true)
+	})
+	if err != nil {
+		return err
+	}
+	return openStream(key, vdo.Ciphertext, ad, w, false)
 }
@@ -0,0 +1,128 @@
+package kademlia
+
+// Contains the wire/file encoding of a VanashingDataObject, so that a VDO can
+// be saved, mailed or pasted and unvanished on any node.
+//
+// All integers are big-endian:
+//
+//	magic       4 bytes  "VNSH"
+//	format      1 byte   VDO_FORMAT_VERSION
+//	suite       1 byte   cipher suite, the VDO's Version
+//	threshold   1 byte
+//	number keys 1 byte
+//	epoch       8 bytes  unix time of the epoch the VDO was created in
+//	seed length 2 bytes
+//	seed        location seed
+//	text length 4 bytes
+//	ciphertext
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"strconv"
+	"time"
+)
+
+const (
+	VDO_MAGIC          = "VNSH"
+	VDO_FORMAT_VERSION = 1
+	VDO_ARMOR_TYPE     = "VANISH VDO"
+	vdoHeaderBytes     = len(VDO_MAGIC) + 4 + 8
+)
+
+var ErrBadVDOFormat = errors.New("not a valid VDO encoding")
+
+func MarshalVDO(vdo VanashingDataObject) ([]byte, error) {
+	if len(vdo.LocationSeed) > 0xffff {
+		return nil, errors.New("location seed too long")
+	}
+	if uint64(len(vdo.Ciphertext)) > 0xffffffff {
+		return nil, errors.New("ciphertext too long")
+	}
+	var buf bytes.Buffer
+	buf.Grow(vdoHeaderBytes + 2 + len(vdo.LocationSeed) + 4 + len(vdo.Ciphertext))
+
+	buf.WriteString(VDO_MAGIC)
+	buf.WriteByte(VDO_FORMAT_VERSION)
+	buf.WriteByte(vdo.Version)
+	buf.WriteByte(vdo.Threshold)
+	buf.WriteByte(vdo.NumberKeys)
+	binary.Write(&buf, binary.BigEndian, vdo.Epoch)
+	binary.Write(&buf, binary.BigEndian, uint16(len(vdo.LocationSeed)))
+	buf.Write(vdo.LocationSeed)
+	binary.Write(&buf, binary.BigEndian, uint32(len(vdo.Ciphertext)))
+	buf.Write(vdo.Ciphertext)
+	return buf.Bytes(), nil
+}
+
+func UnmarshalVDO(data []byte) (vdo VanashingDataObject, err error) {
+	if len(data) < vdoHeaderBytes || string(data[:len(VDO_MAGIC)]) != VDO_MAGIC {
+		return vdo, ErrBadVDOFormat
+	}
+	data = data[len(VDO_MAGIC):]
+	if data[0] != VDO_FORMAT_VERSION {
+		return vdo, errors.New("unsupported VDO format version " + strconv.Itoa(int(data[0])))
+	}
+	vdo.Version = data[1]
+	vdo.Threshold = data[2]
+	vdo.NumberKeys = data[3]
+	vdo.Epoch = int64(binary.BigEndian.Uint64(data[4:12]))
+	data = data[12:]
+
+	if len(data) < 2 {
+		return vdo, ErrBadVDOFormat
+	}
+	seedLength := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < seedLength {
+		return vdo, ErrBadVDOFormat
+	}
+	vdo.LocationSeed = append([]byte(nil), data[:seedLength]...)
+	data = data[seedLength:]
+
+	if len(data) < 4 {
+		return vdo, ErrBadVDOFormat
+	}
+	textLength := uint64(binary.BigEndian.Uint32(data))
+	data = data[4:]
+	if uint64(len(data)) != textLength {
+		return vdo, ErrBadVDOFormat
+	}
+	vdo.Ciphertext = append([]byte(nil), data...)
+	return vdo, nil
+}
+
+// Armored VDOs are PEM blocks, the headers are informational only and the
+// binary encoding is authoritative.
+func ArmorVDO(vdo VanashingDataObject) (string, error) {
+	data, err := MarshalVDO(vdo)
+	if err != nil {
+		return "", err
+	}
+	block := &pem.Block{
+		Type: VDO_ARMOR_TYPE,
+		Headers: map[string]string{
+			"Keys":      strconv.Itoa(int(vdo.NumberKeys)),
+			"Threshold": strconv.Itoa(int(vdo.Threshold)),
+			"Epoch":     time.Unix(vdo.Epoch, 0).UTC().Format(time.RFC3339),
+		},
+		Bytes: data,
+	}
+	return string(pem.EncodeToMemory(block)), nil
+}
+
+// Text around the armored block, such as the rest of an email, is ignored.
+func UnarmorVDO(text []byte) (vdo VanashingDataObject, err error) {
+	for {
+		var block *pem.Block
+		block, text = pem.Decode(text)
+		if block == nil {
+			return vdo, ErrBadVDOFormat
+		}
+		if block.Type == VDO_ARMOR_TYPE {
+			return UnmarshalVDO(block.Bytes)
+		}
+	}
+}
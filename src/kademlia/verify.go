@@ -0,0 +1,95 @@
+package kademlia
+
+// Contains the checks a contact passes before it enters the routing table.
+// Contacts only claim their NodeID, Host and Port, so a request whose sender
+// claims another Host than the one it came from is served but its sender is
+// ignored, and a contact we don't know yet is pinged at its address and only
+// added if it answers with the NodeID it claimed. A known contact never moves
+// to another address, it has to fail and be evicted first.
+//
+// Confirmations run in the background, so a request is never held up by a
+// ping to its sender. The pings confirming a contact are marked so it doesn't
+// confirm us back.
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// At most this many contacts are being confirmed at once, others are
+// dropped, so a flood of made up contacts can't make us ping the world.
+const MAX_PENDING_CONFIRMATIONS = 64
+
+// Set by the server on the requests it receives, never sent.
+type inbound struct {
+	remoteIP net.IP
+}
+
+func (in *inbound) setRemoteIP(ip net.IP) {
+	in.remoteIP = ip
+}
+
+// The contacts being confirmed.
+type confirmations struct {
+	mutex   sync.Mutex
+	pending map[ID]bool
+}
+
+//note the sender of a request that came from remoteIP
+func (k *Kademlia) senderSeen(sender Contact, remoteIP net.IP) {
+	if remoteIP != nil && !sender.Host.Equal(remoteIP) {
+		return
+	}
+	k.learnContact(sender)
+}
+
+//note a contact someone told us about, or that answered us at an address
+//someone told us about
+func (k *Kademlia) learnContact(c Contact) {
+	if k.startConfirming(c) {
+		go k.confirmContact(c)
+	}
+}
+
+//update c if we know it at its address, otherwise whether it needs
+//confirming and nobody else is confirming it
+func (k *Kademlia) startConfirming(c Contact) bool {
+	if c.NodeID.Equals(k.NodeID) {
+		return false
+	}
+	//its key is checked by the confirming ping, its puzzle can be checked
+	//right away
+	if k.config.VerifyNodeIDs && !puzzleSolved(c.NodeID, k.config.IDPuzzleBits) {
+		return false
+	}
+	if known, ok := k.table.Find(c.NodeID); ok {
+		if known.Host.Equal(c.Host) && known.Port == c.Port {
+			k.UpdateContact(c)
+		}
+		return false
+	}
+
+	k.confirming.mutex.Lock()
+	defer k.confirming.mutex.Unlock()
+	if k.confirming.pending[c.NodeID] || len(k.confirming.pending) >= MAX_PENDING_CONFIRMATIONS {
+		return false
+	}
+	k.confirming.pending[c.NodeID] = true
+	return true
+}
+
+//add c if it answers a ping with its NodeID
+func (k *Kademlia) confirmContact(c Contact) {
+	defer func() {
+		k.confirming.mutex.Lock()
+		delete(k.confirming.pending, c.NodeID)
+		k.confirming.mutex.Unlock()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), RPC_TIMEOUT)
+	defer cancel()
+	pong, err := k.sendPing(ctx, c.Host, c.Port, true)
+	if err == nil && pong.NodeID.Equals(c.NodeID) {
+		k.UpdateContact(c)
+	}
+}
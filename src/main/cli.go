@@ -0,0 +1,214 @@
+package main
+
+// One-shot subcommands for scripts:
+//
+//	vanish-cli node --listen host:port [--bootstrap host:port ...] [--store dir]
+//	vanish-cli vanish --bootstrap host:port --in file --out file.vdo [-n 10] [-k 7]
+//	vanish-cli unvanish --bootstrap host:port --in file.vdo --out file
+//
+// Given --verify-ids, the nodes they start have an ID bound to their key and
+// verify the IDs of their peers, --id-bits sets the puzzle IDs must solve.
+// Both must be the same across the network. Without it nodes take a random
+// ID and trust the IDs their peers claim.
+//
+// They exit with EXIT_OK on success, EXIT_FAILURE when the operation failed
+// and EXIT_USAGE when invoked with bad arguments.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+import (
+	"kademlia"
+)
+
+const (
+	EXIT_OK      = 0
+	EXIT_FAILURE = 1
+	EXIT_USAGE   = 2
+)
+
+var subcommands = map[string]func(args []string) int{
+	"node":     nodeCommand,
+	"vanish":   vanishCommand,
+	"unvanish": unvanishCommand,
+}
+
+// Flags shared by every subcommand.
+type nodeFlags struct {
+	listen    string
+	bootstrap addrList
+	store     string
+	verifyIDs bool
+	idBits    int
+}
+
+// A flag that may be given several times.
+type addrList []string
+
+func (l *addrList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *addrList) Set(addr string) error {
+	*l = append(*l, addr)
+	return nil
+}
+
+func newFlagSet(name string, nf *nodeFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&nf.listen, "listen", "localhost:0", "address to serve RPCs on, must be reachable by peers")
+	fs.Var(&nf.bootstrap, "bootstrap", "host:port of a node already in the network, may be repeated")
+	fs.BoolVar(&nf.verifyIDs, "verify-ids", false, "bind the node ID to a key and verify the IDs of peers, the same across the network")
+	fs.IntVar(&nf.idBits, "id-bits", kademlia.ID_PUZZLE_BITS, "bits of the node ID puzzle with --verify-ids, the same across the network")
+	return fs
+}
+
+func fail(format string, a ...interface{}) int {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	return EXIT_FAILURE
+}
+
+// Cancelled on SIGINT or SIGTERM so that a stuck lookup does not need a
+// second signal to kill.
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// Create a node listening on nf.listen. A node verifying the IDs of its
+// peers has its own ID bound to a key, kept in its store if it has one so it
+// comes back with the same ID. Other nodes take a random ID.
+func newNode(nf *nodeFlags) (*kademlia.Kademlia, error) {
+	config := kademlia.DefaultConfig()
+	if nf.store != "" {
+		config.OpenStore = kademlia.LogStoreOpener(nf.store)
+	}
+	if !nf.verifyIDs {
+		return kademlia.NewKademliaWithConfig(kademlia.NewRandomID(), nf.listen, config), nil
+	}
+	config.VerifyNodeIDs = true
+	config.IDPuzzleBits = nf.idBits
+	var identity *kademlia.Identity
+	var err error
+	if nf.store != "" {
+		if err = os.MkdirAll(nf.store, 0700); err == nil {
+			identity, err = kademlia.LoadIdentity(filepath.Join(nf.store, "identity.key"), nf.idBits)
+		}
+	} else {
+		identity, err = kademlia.GenerateIdentity(nf.idBits)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kademlia.NewKademliaWithIdentity(identity, nf.listen, config), nil
+}
+
+// Start a node and join it to the network through the bootstrap nodes.
+func startNode(ctx context.Context, nf *nodeFlags) (*kademlia.Kademlia, error) {
+	k, err := newNode(nf)
+	if err != nil {
+		return nil, err
+	}
+	if len(nf.bootstrap) > 0 {
+		if err := k.Join(ctx, nf.bootstrap); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+func nodeCommand(args []string) int {
+	var nf nodeFlags
+	fs := newFlagSet("node", &nf)
+	fs.StringVar(&nf.store, "store", "", "directory to keep stored values and VDOs in across restarts, in memory if empty")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return EXIT_USAGE
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	k, err := startNode(ctx, &nf)
+	if err != nil {
+		return fail("node: %v", err)
+	}
+	defer k.Close()
+	fmt.Printf("%s %s:%d\n", k.NodeID.AsString(), k.SelfContact.Host, k.SelfContact.Port)
+
+	// Serve until told to stop.
+	<-ctx.Done()
+	return EXIT_OK
+}
+
+func vanishCommand(args []string) int {
+	var nf nodeFlags
+	fs := newFlagSet("vanish", &nf)
+	in := fs.String("in", "", "file to vanish, - for stdin")
+	out := fs.String("out", "", "where to write the VDO, - for stdout")
+	n := fs.Uint("n", 10, "number of key shares")
+	t := fs.Uint("k", 7, "number of shares needed to unvanish")
+	armor := fs.Bool("armor", false, "write the VDO as armored text")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return EXIT_USAGE
+	}
+	if *in == "" || *out == "" || len(nf.bootstrap) == 0 {
+		fmt.Fprintln(os.Stderr, "vanish: --in, --out and --bootstrap are required")
+		return EXIT_USAGE
+	}
+	if *n < 3 || *n > 255 || *t < 2 || *t > *n {
+		fmt.Fprintln(os.Stderr, "vanish: need 2 <= k <= n <= 255 and n >= 3")
+		return EXIT_USAGE
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return fail("vanish: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	k, err := startNode(ctx, &nf)
+	if err != nil {
+		return fail("vanish: %v", err)
+	}
+	//the command exits once the VDO is written, so nothing would be left to
+	//republish the shares, use vanish-file on a running node for that
+	if err := vanishTo(ctx, k, r, byte(*n), byte(*t), 0, *out, *armor); err != nil {
+		return fail("vanish: %v", err)
+	}
+	return EXIT_OK
+}
+
+func unvanishCommand(args []string) int {
+	var nf nodeFlags
+	fs := newFlagSet("unvanish", &nf)
+	in := fs.String("in", "", "VDO to unvanish")
+	out := fs.String("out", "", "where to write the data, - for stdout")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return EXIT_USAGE
+	}
+	if *in == "" || *out == "" || len(nf.bootstrap) == 0 {
+		fmt.Fprintln(os.Stderr, "unvanish: --in, --out and --bootstrap are required")
+		return EXIT_USAGE
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	k, err := startNode(ctx, &nf)
+	if err != nil {
+		return fail("unvanish: %v", err)
+	}
+	if err := unvanishTo(ctx, k, *in, *out); err != nil {
+		return fail("unvanish: %v", err)
+	}
+	return EXIT_OK
+}
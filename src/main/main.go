@@ -3,13 +3,15 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
-	"net"
-	"net/rpc"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -26,8 +28,16 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 
 	// Get the bind and connect connection strings from command-line arguments.
+	verifyIDs := flag.Bool("verify-ids", false, "bind the node ID to a key and verify the IDs of peers, the same across the network")
+	idBits := flag.Int("id-bits", kademlia.ID_PUZZLE_BITS, "bits of the node ID puzzle with --verify-ids, the same across the network")
+	store := flag.String("store", "", "directory to keep stored values and VDOs in across restarts, in memory if empty")
 	flag.Parse()
 	args := flag.Args()
+	if len(args) > 0 {
+		if command, ok := subcommands[args[0]]; ok {
+			os.Exit(command(args[1:]))
+		}
+	}
 	if len(args) != 2 {
 		log.Fatal("Must be invoked with exactly two arguments!\n")
 	}
@@ -36,30 +46,18 @@ func main() {
 
 	// Create the Kademlia instance
 	fmt.Printf("kademlia starting up!\n")
-	kadem := kademlia.NewKademlia(kademlia.NewRandomID(), listenStr)
+	kadem, err := newNode(&nodeFlags{listen: listenStr, store: *store, verifyIDs: *verifyIDs, idBits: *idBits})
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Confirm our server is up with a PING request and then exit.
 	// Your code should loop forever, reading instructions from stdin and
 	// printing their results to stdout. See README.txt for more details.
-	// client, err := rpc.DialHTTP("tcp", firstPeerStr)
-	_, port, _ := net.SplitHostPort(firstPeerStr)
-	client, err := rpc.DialHTTPPath("tcp", firstPeerStr, rpc.DefaultRPCPath+port)
-
-	if err != nil {
-		log.Fatal("DialHTTP: ", err)
+	if err := kadem.Join(context.Background(), []string{firstPeerStr}); err != nil {
+		log.Fatal(err)
 	}
 
-	ping := new(kademlia.PingMessage)
-	ping.MsgID = kademlia.NewRandomID()
-	ping.Sender = kadem.SelfContact
-	var pong kademlia.PongMessage
-	err = client.Call("KademliaCore.Ping", ping, &pong)
-	if err != nil {
-		log.Fatal("Call: ", err)
-	}
-	log.Printf("ping msgID: %s\n", ping.MsgID.AsString())
-	log.Printf("pong msgID: %s\n", pong.MsgID.AsString())
-
 	in := bufio.NewReader(os.Stdin)
 	quit := false
 	for !quit {
@@ -124,29 +122,12 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 		}
 		id, err := kademlia.IDFromString(toks[1])
 		if err != nil {
-			hostname, portstr, err := net.SplitHostPort(toks[1])
-			if err != nil {
-				response = "ERR: Not a valid Node ID or host:port address"
-				return
-			}
-			port, err := strconv.Atoi(portstr)
+			host, port, err := kademlia.ResolveAddr(context.Background(), toks[1])
 			if err != nil {
 				response = "ERR: Not a valid Node ID or host:port address"
 				return
 			}
-			ipAddrStrings, err := net.LookupHost(hostname)
-			if err != nil {
-				response = "ERR: Could not find the provided hostname"
-				return
-			}
-			var host net.IP
-			for i := 0; i < len(ipAddrStrings); i++ {
-				host = net.ParseIP(ipAddrStrings[i])
-				if host.To4() != nil {
-					break
-				}
-			}
-			response = k.DoPing(host, uint16(port))
+			response = k.DoPing(host, port)
 			return
 		}
 		c, err := k.FindContact(id)
@@ -319,8 +300,156 @@ func executeLine(k *kademlia.Kademlia, line string) (response string) {
 		}
 		response = k.DoUnVanishData(contact, vdoId)
 
+	case toks[0] == "vanish-file":
+		if len(toks) < 5 || len(toks) > 6 {
+			response = "usage: vanish-file [path] [numberKeys] [threshold] [time] [out.vdo]"
+			return
+		}
+		out := toks[1] + ".vdo"
+		if len(toks) == 6 {
+			out = toks[5]
+		}
+		response = vanishFile(k, toks[1], toks[2], toks[3], toks[4], out)
+
+	case toks[0] == "unvanish-file":
+		if len(toks) != 3 {
+			response = "usage: unvanish-file [in.vdo] [outpath]"
+			return
+		}
+		response = unvanishFile(k, toks[1], toks[2])
+
+	case toks[0] == "rpc_stats":
+		if len(toks) != 1 {
+			response = "usage: rpc_stats"
+			return
+		}
+		response = formatRPCStats(k.RPCStats())
+
 	default:
 		response = "ERR: Unknown command"
 	}
 	return
 }
+
+// One line per method: the requests served and the ones rate limited.
+func formatRPCStats(stats kademlia.RPCStats) string {
+	methods := make([]string, 0, len(stats.Served))
+	for method := range stats.Served {
+		methods = append(methods, method)
+	}
+	for method := range stats.Limited {
+		if _, ok := stats.Served[method]; !ok {
+			methods = append(methods, method)
+		}
+	}
+	sort.Strings(methods)
+	lines := make([]string, len(methods))
+	for i, method := range methods {
+		lines[i] = fmt.Sprintf("%s served=%d limited=%d", method, stats.Served[method], stats.Limited[method])
+	}
+	return "OK: " + strings.Join(lines, "\n    ")
+}
+
+func parseByteArg(name string, s string) (byte, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > 255 {
+		return 0, errors.New("ERR: Provided an invalid " + name + " (" + s + ")")
+	}
+	return byte(n), nil
+}
+
+// Vanish the file at path and write the encoded VDO to out.
+func vanishFile(k *kademlia.Kademlia, path, numberKeys, threshold, period, out string) string {
+	n, err := parseByteArg("numberKeys", numberKeys)
+	if err != nil {
+		return err.Error()
+	}
+	t, err := parseByteArg("threshold", threshold)
+	if err != nil {
+		return err.Error()
+	}
+	validPeriod, err := strconv.Atoi(period)
+	if err != nil {
+		return "ERR: Provided an invalid time (" + period + ")"
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return "ERR: " + err.Error()
+	}
+	defer in.Close()
+	if err := vanishTo(context.Background(), k, in, n, t, validPeriod, out, false); err != nil {
+		return "ERR: " + err.Error()
+	}
+	return "ok, VDO written to " + out
+}
+
+// Vanish everything read from in and write the VDO to out, armored or not.
+func vanishTo(ctx context.Context, k *kademlia.Kademlia, in io.Reader, n, t byte, validPeriod int, out string, armor bool) error {
+	vdo, err := kademlia.VanishReader(ctx, k, in, n, t, validPeriod)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if armor {
+		text, err := kademlia.ArmorVDO(vdo)
+		if err != nil {
+			return err
+		}
+		data = []byte(text)
+	} else {
+		data, err = kademlia.MarshalVDO(vdo)
+		if err != nil {
+			return err
+		}
+	}
+	if out == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(out, data, 0600)
+}
+
+// Read a binary or armored VDO from path.
+func readVDO(path string) (vdo kademlia.VanashingDataObject, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if strings.HasPrefix(string(data), kademlia.VDO_MAGIC) {
+		return kademlia.UnmarshalVDO(data)
+	}
+	return kademlia.UnarmorVDO(data)
+}
+
+// Unvanish the VDO stored at path into outpath.
+func unvanishFile(k *kademlia.Kademlia, path, outpath string) string {
+	if err := unvanishTo(context.Background(), k, path, outpath); err != nil {
+		return "ERR: " + err.Error()
+	}
+	return "ok, Unvanished to " + outpath
+}
+
+// Unvanish the VDO stored at path into outpath, "-" is stdout. A partly
+// written output file is removed on failure.
+func unvanishTo(ctx context.Context, k *kademlia.Kademlia, path, outpath string) error {
+	vdo, err := readVDO(path)
+	if err != nil {
+		return err
+	}
+	if outpath == "-" {
+		return kademlia.UnvanishWriter(ctx, k, vdo, os.Stdout)
+	}
+	out, err := os.Create(outpath)
+	if err != nil {
+		return err
+	}
+	err = kademlia.UnvanishWriter(ctx, k, vdo, out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(outpath)
+	}
+	return err
+}